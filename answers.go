@@ -1,25 +1,173 @@
 package main
 
 import (
-    "errors"
+    "github.com/inSituo/Denormalizer/model"
     "gopkg.in/mgo.v2"
     "gopkg.in/mgo.v2/bson"
+    "sort"
 )
 
+func init() {
+    RegisterCommand(&Command{
+        Name:    "A",
+        Desc:    "Answer",
+        Args:    []CommandArg{{"ID", ARG_OID}},
+        Options: viewerOptions,
+        Parse:   parseOidArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(oidArgs)
+            return w.GetAnswer(a.id, a.viewer)
+        },
+    })
+    RegisterCommand(&Command{
+        Name:    "AM",
+        Desc:    "Many answers, in the requested order, null if missing",
+        Args:    []CommandArg{{"ID...", ARG_OID}},
+        Options: viewerOptions,
+        Parse:   parseOidsArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(oidsArgs)
+            return w.GetAnswers(a.ids, a.viewer)
+        },
+    })
+    RegisterCommand(&Command{
+        Name:    "QTA",
+        Desc:    "Question top answers",
+        Args:    []CommandArg{{"ID", ARG_OID}, {"COUNT", ARG_INT}, {"PAGE", ARG_INT}},
+        Options: append([]string{OPTION_ENVELOPE}, viewerOptions...),
+        Parse:   parseOidCountPageArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(oidCountPageArgs)
+            if a.cursor != nil {
+                return w.GetTopAnswersPage(a.id, a.count, a.cursor, a.viewer)
+            }
+            items, exists, err := w.GetTopAnswers(a.id, a.count, a.page, a.viewer)
+            return w.envelope(a, w.CountAnswers, items, exists, err)
+        },
+    })
+    RegisterCommand(&Command{
+        Name:    "QLA",
+        Desc:    "Question latest answers",
+        Args:    []CommandArg{{"ID", ARG_OID}, {"COUNT", ARG_INT}, {"PAGE", ARG_INT}},
+        Options: append([]string{OPTION_ENVELOPE}, viewerOptions...),
+        Parse:   parseOidCountPageArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(oidCountPageArgs)
+            if a.cursor != nil {
+                return w.GetLatestAnswersPage(a.id, a.count, a.cursor, a.viewer)
+            }
+            items, exists, err := w.GetLatestAnswers(a.id, a.count, a.page, a.viewer)
+            return w.envelope(a, w.CountAnswers, items, exists, err)
+        },
+    })
+}
+
 // getAnswer generates a denormalized answer data. It queries the database
 // for the data needed to display the answer.
 // On success, it returns a pointer to a 'Answer' struct.
-// Params: id - The requested answer ID
+// Params:
+//  1. id - The requested answer ID
+//  2. viewer - The viewer of the request, or nil
+//
 // Return:
 //  1. Pointer to a Answer struct
 //  2. (bool) Does the requested answer exist?
 //  3. (error) Nil or an error
-func (w *Worker) GetAnswer(id bson.ObjectId) (*Answer, bool, error) {
-    pipe := w.db.Answers.Pipe([]bson.M{
+func (w *Worker) GetAnswer(id bson.ObjectId, viewer *Viewer) (*model.Answer, bool, error) {
+    pipe := w.db.Pipe(w.db.Answers, answerPipeline(bson.M{"_id": id}, viewer))
+    var a model.Answer
+    if err := pipe.One(&a); err != nil {
+        if err != mgo.ErrNotFound {
+            return nil, false, err
+        }
+        return nil, false, nil
+    }
+    as := []model.Answer{a}
+    names, err := w.getUserNames(answerUids(as))
+    if err != nil {
+        return nil, false, err
+    }
+    // fill-in the missing information in the answer:
+    if err := w.settings.setAnswerNames(as, names, viewer); err != nil {
+        return nil, false, err
+    }
+    return &as[0], true, nil
+}
+
+// getAnswers generates the denormalized data of many answers with a single
+// query, and looks up the names of all their authors with another.
+// Params:
+//  1. ids - The requested answer IDs
+//  2. viewer - The viewer of the request, or nil
+//
+// Return:
+//  1. Pointers to Answer structs, in the order of 'ids'. The pointers of
+//     answers which don't exist, or whose authors don't exist, are nil.
+//  2. (bool) Always true, missing answers are nil entries
+//  3. (error) Nil or an error
+func (w *Worker) GetAnswers(ids []bson.ObjectId, viewer *Viewer) ([]*model.Answer, bool, error) {
+    pipe := w.db.Pipe(w.db.Answers, answerPipeline(bson.M{"_id": bson.M{"$in": ids}}, viewer))
+    var as []model.Answer
+    if err := pipe.All(&as); err != nil && err != mgo.ErrNotFound {
+        return nil, false, err
+    }
+    names, err := w.getUserNames(answerUids(as))
+    if err != nil {
+        return nil, false, err
+    }
+    // a missing author only fails its own answer:
+    as = knownAuthors(as, names)
+    if err := w.settings.setAnswerNames(as, names, viewer); err != nil {
+        return nil, false, err
+    }
+    found := make(map[bson.ObjectId]*model.Answer, len(as))
+    for i := range as {
+        found[as[i].ID] = &as[i]
+    }
+    res := make([]*model.Answer, len(ids))
+    for i, id := range ids {
+        res[i] = found[id]
+    }
+    return res, true, nil
+}
+
+// The aggregation pipeline which brings the answers matching 'match' to their
+// denormalized form, except for the authors' names, with the flags of the
+// viewer if it's not nil.
+func answerPipeline(match bson.M, viewer *Viewer) []bson.M {
+    id := bson.M{
+        "_id":        "$_id",
+        "qid":        "$qid",
+        "ts":         "$ts",
+        "ranking":    "$ranking",
+        "anon":       "$anon",
+        "thanks":     bson.M{"$size": "$thnksuids"},
+        "thumbups":   bson.M{"$size": "$thupsuids"},
+        "thumbdowns": bson.M{"$size": "$thdwnuids"},
+    }
+    project := bson.M{
+        "_id":        "$_id._id",
+        "qid":        "$_id.qid",
+        "lts":        "$_id.ts",
+        "ranking":    "$_id.ranking",
+        "thanks":     "$_id.thanks",
+        "thumbups":   "$_id.thumbups",
+        "thumbdowns": "$_id.thumbdowns",
+        "anon":       "$_id.anon",
+        "fuid":       "$first_rev.uid",
+        "fts":        "$first_rev.ts",
+        "luid":       "$last_rev.uid",
+        "locs":       "$last_rev.locs",
+        "content":    "$last_rev.content",
+    }
+    viewer.addFlags(id, project, map[string]string{
+        "viewerThanked":     "$thnksuids",
+        "viewerThumbedUp":   "$thupsuids",
+        "viewerThumbedDown": "$thdwnuids",
+    })
+    return []bson.M{
         {
-            "$match": bson.M{
-                "_id": id,
-            },
+            "$match": match,
         },
         {
             "$unwind": "$revs",
@@ -31,16 +179,7 @@ func (w *Worker) GetAnswer(id bson.ObjectId) (*Answer, bool, error) {
         },
         {
             "$group": bson.M{
-                "_id": bson.M{
-                    "_id":        "$_id",
-                    "qid":        "$qid",
-                    "ts":         "$ts",
-                    "ranking":    "$ranking",
-                    "anon":       "$anon",
-                    "thanks":     bson.M{"$size": "$thnksuids"},
-                    "thumbups":   bson.M{"$size": "$thupsuids"},
-                    "thumbdowns": bson.M{"$size": "$thdwnuids"},
-                },
+                "_id": id,
                 "first_rev": bson.M{
                     "$first": "$revs",
                 },
@@ -50,180 +189,137 @@ func (w *Worker) GetAnswer(id bson.ObjectId) (*Answer, bool, error) {
             },
         },
         {
-            "$project": bson.M{
-                "_id":        "$_id._id",
-                "qid":        "$_id.qid",
-                "lts":        "$_id.ts",
-                "ranking":    "$_id.ranking",
-                "thanks":     "$_id.thanks",
-                "thumbups":   "$_id.thumbups",
-                "thumbdowns": "$_id.thumbdowns",
-                "anon":       "$_id.anon",
-                "fuid":       "$first_rev.uid",
-                "fts":        "$first_rev.ts",
-                "luid":       "$last_rev.uid",
-                "locs":       "$last_rev.locs",
-                "content":    "$last_rev.content",
-            },
+            "$project": project,
         },
-    })
-    var a Answer
-    if err := pipe.One(&a); err != nil {
-        if err != mgo.ErrNotFound {
-            return nil, false, err
-        }
-        return nil, false, nil
-    }
-    uids := []bson.ObjectId{a.Fuid}
-    if a.Luid != a.Fuid {
-        uids = append(uids, a.Luid)
-    }
-    // get the last and first users display data from the db
-    query := w.db.Users.
-        Find(bson.M{"_id": bson.M{"$in": uids}}).
-        Select(bson.M{"_id": true, "name": true})
-    users := make([]struct {
-        ID   bson.ObjectId `bson:"_id"`
-        Name string        `bson:"name"`
-    }, len(uids))
-    if err := query.All(&users); err != nil {
-        if err != mgo.ErrNotFound {
-            return nil, false, err
-        }
     }
-    if len(users) < len(uids) {
-        return nil, false, errors.New("Unable to find user")
+}
+
+// The order of a list of answers: by a descending field of the answers
+// collection, then by descending ID.
+type answerOrder struct {
+    // The field in the answers collection.
+    field string
+
+    // The value of the field in a denormalized answer.
+    key func(a *model.Answer) int
+}
+
+var (
+    topAnswers = answerOrder{
+        field: "ranking",
+        key:   func(a *model.Answer) int { return a.Ranking },
     }
-    names := make(map[bson.ObjectId]string)
-    for _, v := range users {
-        names[v.ID] = v.Name
+    latestAnswers = answerOrder{
+        field: "ts",
+        key:   func(a *model.Answer) int { return a.LTS },
     }
-    // fill-in the missing information in the answer:
-    a.Fudisp = names[a.Fuid]
-    a.Ludisp = names[a.Luid]
-    return &a, true, nil
+)
+
+func (w *Worker) GetTopAnswers(qid bson.ObjectId, count, page int, viewer *Viewer) (*[]model.Answer, bool, error) {
+    as, exists, err := w.getTopAnswers(qid, count, page, viewer)
+    return w.withAnswerNames(as, exists, err, viewer)
+}
+
+func (w *Worker) GetLatestAnswers(qid bson.ObjectId, count, page int, viewer *Viewer) (*[]model.Answer, bool, error) {
+    as, exists, err := w._getXAnswers(qid, count, count*page, nil, latestAnswers, viewer)
+    return w.withAnswerNames(as, exists, err, viewer)
 }
 
-func (w *Worker) GetTopAnswers(qid bson.ObjectId, count, page int) (*[]Answer, bool, error) {
-    return w._getXAnswers(
-        qid,
-        count,
-        page,
-        bson.M{"ranking": -1},
-        bson.M{"ranking": -1, "revs.ts": 1},
-    )
+func (w *Worker) getTopAnswers(qid bson.ObjectId, count, page int, viewer *Viewer) ([]model.Answer, bool, error) {
+    return w._getXAnswers(qid, count, count*page, nil, topAnswers, viewer)
 }
 
-func (w *Worker) GetLatestAnswers(qid bson.ObjectId, count, page int) (*[]Answer, bool, error) {
-    return w._getXAnswers(
-        qid,
-        count,
-        page,
-        bson.M{"ts": -1},
-        bson.M{"ts": -1, "revs.ts": 1},
-    )
+// Same as 'GetTopAnswers', but the page starts after the cursor.
+func (w *Worker) GetTopAnswersPage(qid bson.ObjectId, count int, cursor *Cursor, viewer *Viewer) (*model.Page, bool, error) {
+    return w.answersPage(qid, count, cursor, topAnswers, viewer)
 }
 
-func (w *Worker) _getXAnswers(qid bson.ObjectId, count, page int, outerSort, innerSort bson.M) (*[]Answer, bool, error) {
-    pipe := w.db.Answers.Pipe([]bson.M{
+// Same as 'GetLatestAnswers', but the page starts after the cursor.
+func (w *Worker) GetLatestAnswersPage(qid bson.ObjectId, count int, cursor *Cursor, viewer *Viewer) (*model.Page, bool, error) {
+    return w.answersPage(qid, count, cursor, latestAnswers, viewer)
+}
+
+// A page of the answers of a question starting after the cursor.
+// Return:
+//  1. Pointer to a Page struct, with the answers and the next page's cursor
+//  2. (bool) Always true, a question without answers has an empty page
+//  3. (error) Nil or an error
+func (w *Worker) answersPage(qid bson.ObjectId, count int, cursor *Cursor, order answerOrder, viewer *Viewer) (*model.Page, bool, error) {
+    as, _, err := w._getXAnswers(qid, count, 0, cursor, order, viewer)
+    if err != nil {
+        return nil, false, err
+    }
+    if as == nil {
+        as = []model.Answer{}
+    }
+    if _, _, err := w.withAnswerNames(as, true, nil, viewer); err != nil {
+        return nil, false, err
+    }
+    page := model.Page{Items: as}
+    if len(as) == count {
+        last := &as[len(as)-1]
+        next, err := w.settings.encodeCursor(&Cursor{Cmd: cursor.Cmd, ID: qid, Key: order.key(last), Last: last.ID})
+        if err != nil {
+            return nil, false, err
+        }
+        page.Next = next
+    }
+    return &page, true, nil
+}
+
+// Fill in the authors' names of answers returned by '_getXAnswers'.
+func (w *Worker) withAnswerNames(as []model.Answer, exists bool, err error, viewer *Viewer) (*[]model.Answer, bool, error) {
+    if err != nil || !exists {
+        return nil, exists, err
+    }
+    names, err := w.getUserNames(answerUids(as))
+    if err != nil {
+        return nil, false, err
+    }
+    // fill-in the missing information in the answers:
+    if err := w.settings.setAnswerNames(as, names, viewer); err != nil {
+        return nil, false, err
+    }
+    return &as, true, nil
+}
+
+// A page of the answers of a question, without their authors' names. The page
+// starts after 'skip' answers, or after the cursor if it's not nil. The flags
+// of the viewer are set if it's not nil.
+func (w *Worker) _getXAnswers(qid bson.ObjectId, count, skip int, cursor *Cursor, order answerOrder, viewer *Viewer) ([]model.Answer, bool, error) {
+    match := bson.M{"qid": qid}
+    if cursor != nil && !cursor.start() {
+        match["$or"] = cursor.after(order.field)
+    }
+    // the rest of the stages are the same as a single answer's:
+    pipe := w.db.Pipe(w.db.Answers, append([]bson.M{
         {
-            "$match": bson.M{
-                "qid": qid,
-            },
+            "$match": match,
         },
         {
-            "$sort": outerSort,
+            "$sort": bson.D{{Name: order.field, Value: -1}, {Name: "_id", Value: -1}},
         },
         {
-            "$skip": count * page,
+            "$skip": skip,
         },
         {
             "$limit": count,
         },
-        {
-            "$unwind": "$revs",
-        },
-        {
-            "$sort": innerSort,
-        },
-        {
-            "$group": bson.M{
-                "_id": bson.M{
-                    "_id":        "$_id",
-                    "qid":        "$qid",
-                    "ts":         "$ts",
-                    "ranking":    "$ranking",
-                    "anon":       "$anon",
-                    "thanks":     bson.M{"$size": "$thnksuids"},
-                    "thumbups":   bson.M{"$size": "$thupsuids"},
-                    "thumbdowns": bson.M{"$size": "$thdwnuids"},
-                },
-                "first_rev": bson.M{
-                    "$first": "$revs",
-                },
-                "last_rev": bson.M{
-                    "$last": "$revs",
-                },
-            },
-        },
-        {
-            "$project": bson.M{
-                "_id":        "$_id._id",
-                "qid":        "$_id.qid",
-                "lts":        "$_id.ts",
-                "ranking":    "$_id.ranking",
-                "thanks":     "$_id.thanks",
-                "thumbups":   "$_id.thumbups",
-                "thumbdowns": "$_id.thumbdowns",
-                "anon":       "$_id.anon",
-                "fuid":       "$first_rev.uid",
-                "fts":        "$first_rev.ts",
-                "luid":       "$last_rev.uid",
-                "locs":       "$last_rev.locs",
-                "content":    "$last_rev.content",
-            },
-        },
-    })
-    var as []Answer
+    }, answerPipeline(bson.M{}, viewer)[1:]...))
+    var as []model.Answer
     if err := pipe.All(&as); err != nil {
         if err != mgo.ErrNotFound {
             return nil, false, err
         }
         return nil, false, nil
     }
-    uniqueuids := make(map[bson.ObjectId]bool)
-    for _, a := range as {
-        uniqueuids[a.Fuid] = true
-        uniqueuids[a.Luid] = true
-    }
-    uids := make([]bson.ObjectId, 0, len(uniqueuids))
-    for uid, _ := range uniqueuids {
-        uids = append(uids, uid)
-    }
-    // get the last and first users display data from the db
-    query := w.db.Users.
-        Find(bson.M{"_id": bson.M{"$in": uids}}).
-        Select(bson.M{"_id": true, "name": true})
-    users := make([]struct {
-        ID   bson.ObjectId `bson:"_id"`
-        Name string        `bson:"name"`
-    }, len(uids))
-    if err := query.All(&users); err != nil {
-        if err != mgo.ErrNotFound {
-            return nil, false, err
+    // grouping the revisions loses the order of the answers:
+    sort.Slice(as, func(i, j int) bool {
+        ki, kj := order.key(&as[i]), order.key(&as[j])
+        if ki != kj {
+            return ki > kj
         }
-    }
-    if len(users) < len(uids) {
-        return nil, false, errors.New("unable to find user")
-    }
-    names := make(map[bson.ObjectId]string)
-    for _, v := range users {
-        names[v.ID] = v.Name
-    }
-    // fill-in the missing information in the answers:
-    for i, _ := range as {
-        as[i].Fudisp = names[as[i].Fuid]
-        as[i].Ludisp = names[as[i].Luid]
-    }
-    return &as, true, nil
+        return as[i].ID > as[j].ID
+    })
+    return as, true, nil
 }
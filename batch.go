@@ -0,0 +1,73 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+const (
+    // Runs several commands in one request. It is handled by the dispatcher
+    // rather than by a worker, see 'splitBatch'.
+    BATCH_COMMAND = "BATCH"
+
+    // Maximum number of commands in one batch.
+    BATCH_MAX_COMMANDS = 64
+)
+
+// Split the parts of a BATCH request into the parts of its commands.
+// Each command is prefixed by its number of parts, including the command name
+// and its options:
+//
+//	BATCH 2 Q <qid> 4 QTA <qid> 10 0 5 QLC <qid> 10 0 @nocache @timeout=250
+//
+// The option parts following the last command apply to every command of the
+// batch, unless a command sets them itself.
+// Return:
+//  1. The parts of each command
+//  2. The batch options
+//  3. (error) Nil or an error if the request is malformed
+func splitBatch(params []string) ([][]string, map[string]string, error) {
+    cmds := make([][]string, 0)
+    rest := params[1:]
+    for len(rest) > 0 && !strings.HasPrefix(rest[0], OPTION_PREFIX) {
+        n, err := strconv.Atoi(rest[0])
+        if err != nil || n < 1 {
+            return nil, nil, badArgs(fmt.Sprintf("Invalid batch part count '%s'", rest[0]))
+        }
+        if n > len(rest)-1 {
+            return nil, nil, badArgs("Batch part count exceeds the request")
+        }
+        cmd := rest[1 : n+1]
+        if cmd[0] == BATCH_COMMAND {
+            return nil, nil, badArgs("Batches can't be nested")
+        }
+        if len(cmds) == BATCH_MAX_COMMANDS {
+            return nil, nil, badArgs(fmt.Sprintf("Too many commands in batch (max %d)", BATCH_MAX_COMMANDS))
+        }
+        cmds = append(cmds, cmd)
+        rest = rest[n+1:]
+    }
+    if len(cmds) == 0 {
+        return nil, nil, badArgs("Empty batch")
+    }
+    // what's left are the batch options:
+    for _, part := range rest {
+        if !strings.HasPrefix(part, OPTION_PREFIX) {
+            return nil, nil, badArgs("Unexpected parts after the batch options")
+        }
+    }
+    _, opts := splitOptions(append([]string{BATCH_COMMAND}, rest...))
+    return cmds, opts, nil
+}
+
+// Merge the batch options into the options of one of its commands. Options
+// set by the command take precedence.
+func mergeOptions(opts, batch map[string]string) map[string]string {
+    for name, value := range batch {
+        if _, found := opts[name]; !found {
+            opts[name] = value
+        }
+    }
+    return opts
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestSplitBatch(t *testing.T) {
+    qid := "53fb63a4472dcb6b32e99260"
+    cmds, opts, err := splitBatch([]string{
+        "BATCH",
+        "2", "Q", qid,
+        "5", "QTA", qid, "10", "0", "@timeout=100",
+        "@nocache", "@timeout=250",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(cmds, [][]string{{"Q", qid}, {"QTA", qid, "10", "0", "@timeout=100"}}) {
+        t.Error("unexpected commands", cmds)
+    }
+    if !reflect.DeepEqual(opts, map[string]string{"nocache": "", "timeout": "250"}) {
+        t.Error("unexpected options", opts)
+    }
+    // options set by a command take precedence:
+    _, copts := splitOptions(cmds[1])
+    if merged := mergeOptions(copts, opts); merged["timeout"] != "100" || len(merged) != 2 {
+        t.Error("unexpected merged options", merged)
+    }
+
+    for _, params := range [][]string{
+        {"BATCH"},
+        {"BATCH", "@nocache"},
+        {"BATCH", "x", "Q", qid},
+        {"BATCH", "0"},
+        {"BATCH", "3", "Q", qid},
+        {"BATCH", "2", "Q", qid, "@nocache", "Q"},
+        {"BATCH", "2", "BATCH", "1"},
+    } {
+        if _, _, err := splitBatch(params); err == nil {
+            t.Error("expected an error", params)
+        }
+    }
+}
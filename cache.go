@@ -0,0 +1,250 @@
+package main
+
+import (
+    "container/list"
+    "fmt"
+    "gopkg.in/mgo.v2/bson"
+    "reflect"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Tags the cached lists of questions which any new question may change.
+const TAG_QUESTIONS = "questions"
+
+// The tag of the cached results counting the activity of a user, which the
+// user's new questions and answers change.
+func profileTag(uid string) string {
+    return "profile:" + uid
+}
+
+// The tags of the commands listing questions, see 'TAG_QUESTIONS'.
+func questionListTags(params []string) []string {
+    return []string{TAG_QUESTIONS}
+}
+
+// A size bounded LRU cache of command results, shared by all the workers.
+// Entries are the JSON payloads produced by the workers, keyed by the command
+// and its arguments. Each command has its own time to live; commands without
+// one are never cached.
+// Entries are tagged with the IDs of the objects they were made of, so they
+// can be invalidated when one of these objects changes.
+type Cache struct {
+    lock  sync.Mutex
+    size  int
+    ttls  map[string]time.Duration
+    lru   *list.List
+    items map[string]*list.Element
+
+    // The keys of the entries carrying each tag.
+    tagged map[string]map[string]bool
+}
+
+type cacheEntry struct {
+    key     string
+    payload []byte
+    exists  bool
+    expires time.Time
+    tags    []string
+}
+
+// Construct a new cache which holds up to 'size' entries. A size of zero
+// disables the cache.
+func NewCache(size int, ttls map[string]time.Duration) *Cache {
+    return &Cache{
+        size:   size,
+        ttls:   ttls,
+        lru:    list.New(),
+        items:  make(map[string]*list.Element),
+        tagged: make(map[string]map[string]bool),
+    }
+}
+
+// The cache key of a request.
+func cacheKey(params []string) string {
+    return strings.Join(params, "\x00")
+}
+
+// Parse the time to live of each command, from a comma separated list of
+// 'COMMAND=DURATION' pairs, such as "Q=30s,QTA=10s".
+func parseTTLs(spec string) (map[string]time.Duration, error) {
+    ttls := make(map[string]time.Duration)
+    if spec == "" {
+        return ttls, nil
+    }
+    for _, pair := range strings.Split(spec, ",") {
+        kv := strings.SplitN(pair, "=", 2)
+        if len(kv) != 2 {
+            return nil, fmt.Errorf("invalid cache TTL '%s'", pair)
+        }
+        ttl, err := time.ParseDuration(kv[1])
+        if err != nil {
+            return nil, fmt.Errorf("invalid cache TTL '%s': %s", pair, err)
+        }
+        ttls[strings.TrimSpace(kv[0])] = ttl
+    }
+    return ttls, nil
+}
+
+// Is the command cacheable?
+func (c *Cache) Caches(cmd string) bool {
+    return c.size > 0 && c.ttls[cmd] > 0
+}
+
+// Get the cached result of a request.
+// Return:
+//  1. The JSON payload
+//  2. (bool) Does the requested object exist?
+//  3. (bool) Was a fresh entry found?
+func (c *Cache) Get(params []string) ([]byte, bool, bool) {
+    if !c.Caches(params[0]) {
+        return nil, false, false
+    }
+    key := cacheKey(params)
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    el, found := c.items[key]
+    if !found {
+        cacheMisses.Add(1)
+        return nil, false, false
+    }
+    entry := el.Value.(*cacheEntry)
+    if time.Now().After(entry.expires) {
+        c.remove(el)
+        cacheMisses.Add(1)
+        return nil, false, false
+    }
+    c.lru.MoveToFront(el)
+    cacheHits.Add(1)
+    return entry.payload, entry.exists, true
+}
+
+// Store the result of a request, tagged with 'tags'. The least recently used
+// entry is evicted if the cache is full.
+func (c *Cache) Put(params []string, payload []byte, exists bool, tags []string) {
+    if !c.Caches(params[0]) {
+        return
+    }
+    entry := &cacheEntry{
+        key:     cacheKey(params),
+        payload: payload,
+        exists:  exists,
+        expires: time.Now().Add(c.ttls[params[0]]),
+        tags:    tags,
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if el, found := c.items[entry.key]; found {
+        c.remove(el)
+    }
+    c.items[entry.key] = c.lru.PushFront(entry)
+    for _, tag := range tags {
+        if c.tagged[tag] == nil {
+            c.tagged[tag] = make(map[string]bool)
+        }
+        c.tagged[tag][entry.key] = true
+    }
+    for c.lru.Len() > c.size {
+        c.remove(c.lru.Back())
+    }
+}
+
+// Evict every entry carrying the tag. Returns the number of evicted entries.
+func (c *Cache) Invalidate(tag string) int {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    keys := c.tagged[tag]
+    n := len(keys)
+    // removing an entry deletes its key from 'keys' as well:
+    for key := range keys {
+        c.remove(c.items[key])
+    }
+    cacheInvalidations.Add(int64(n))
+    return n
+}
+
+// Evict all the entries.
+func (c *Cache) Purge() {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    cacheInvalidations.Add(int64(c.lru.Len()))
+    c.lru.Init()
+    c.items = make(map[string]*list.Element)
+    c.tagged = make(map[string]map[string]bool)
+}
+
+// Number of entries in the cache, including expired ones which were not
+// evicted yet.
+func (c *Cache) Len() int {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.lru.Len()
+}
+
+func (c *Cache) remove(el *list.Element) {
+    entry := el.Value.(*cacheEntry)
+    c.lru.Remove(el)
+    delete(c.items, entry.key)
+    for _, tag := range entry.tags {
+        delete(c.tagged[tag], entry.key)
+        if len(c.tagged[tag]) == 0 {
+            delete(c.tagged, tag)
+        }
+    }
+}
+
+// The tags of a result: the hex IDs of every object it embeds, and of the
+// objects given as arguments of the request, so that empty results are
+// tagged as well, and the tags of the command (see 'Command.Tags').
+func cacheTags(params []string, res interface{}) []string {
+    ids := make(map[bson.ObjectId]bool)
+    for _, p := range params[1:] {
+        if bson.IsObjectIdHex(p) {
+            ids[bson.ObjectIdHex(p)] = true
+        }
+    }
+    collectIds(reflect.ValueOf(res), ids)
+    tags := make([]string, 0, len(ids))
+    for id := range ids {
+        tags = append(tags, id.Hex())
+    }
+    if cmd, found := commands[params[0]]; found && cmd.Tags != nil {
+        tags = append(tags, cmd.Tags(params)...)
+    }
+    return tags
+}
+
+var objectIdType = reflect.TypeOf(bson.ObjectId(""))
+
+// Walk a value and collect all the ObjectIds in it.
+func collectIds(v reflect.Value, ids map[bson.ObjectId]bool) {
+    if !v.IsValid() {
+        return
+    }
+    if v.Type() == objectIdType {
+        if id := bson.ObjectId(v.String()); id.Valid() {
+            ids[id] = true
+        }
+        return
+    }
+    switch v.Kind() {
+    case reflect.Ptr, reflect.Interface:
+        collectIds(v.Elem(), ids)
+    case reflect.Struct:
+        for i := 0; i < v.NumField(); i++ {
+            collectIds(v.Field(i), ids)
+        }
+    case reflect.Slice, reflect.Array:
+        if v.Type().Elem().Kind() == reflect.Uint8 {
+            return
+        }
+        for i := 0; i < v.Len(); i++ {
+            collectIds(v.Index(i), ids)
+        }
+    case reflect.Map:
+        for _, k := range v.MapKeys() {
+            collectIds(v.MapIndex(k), ids)
+        }
+    }
+}
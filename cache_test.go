@@ -0,0 +1,84 @@
+package main
+
+import (
+    "github.com/inSituo/Denormalizer/model"
+    "gopkg.in/mgo.v2/bson"
+    "testing"
+    "time"
+)
+
+func TestCacheLRU(t *testing.T) {
+    c := NewCache(2, map[string]time.Duration{"Q": time.Minute})
+    q1 := []string{"Q", "1"}
+    q2 := []string{"Q", "2"}
+    q3 := []string{"Q", "3"}
+    c.Put(q1, []byte("1"), true, nil)
+    c.Put(q2, []byte("2"), true, nil)
+    // q1 becomes the most recently used:
+    if payload, exists, found := c.Get(q1); !found || !exists || string(payload) != "1" {
+        t.Error("expected a hit for q1", string(payload), exists, found)
+    }
+    c.Put(q3, []byte("3"), false, nil)
+    if _, _, found := c.Get(q2); found {
+        t.Error("q2 should have been evicted")
+    }
+    if _, exists, found := c.Get(q3); !found || exists {
+        t.Error("expected an empty hit for q3", exists, found)
+    }
+    if c.Len() != 2 {
+        t.Error("expected 2 entries, got", c.Len())
+    }
+}
+
+func TestCacheTTL(t *testing.T) {
+    c := NewCache(10, map[string]time.Duration{"Q": time.Millisecond})
+    q := []string{"Q", "1"}
+    c.Put(q, []byte("1"), true, nil)
+    time.Sleep(5 * time.Millisecond)
+    if _, _, found := c.Get(q); found {
+        t.Error("expired entry was returned")
+    }
+    // commands without a TTL are not cached:
+    c.Put([]string{"STATS"}, []byte("{}"), true, nil)
+    if _, _, found := c.Get([]string{"STATS"}); found {
+        t.Error("STATS should not be cached")
+    }
+}
+
+func TestParseTTLs(t *testing.T) {
+    ttls, err := parseTTLs("Q=30s, QTA=1m")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ttls["Q"] != 30*time.Second || ttls["QTA"] != time.Minute {
+        t.Error("unexpected TTLs", ttls)
+    }
+    if _, err := parseTTLs("Q=soon"); err == nil {
+        t.Error("expected an error for an invalid duration")
+    }
+}
+
+func TestCacheInvalidate(t *testing.T) {
+    c := NewCache(10, map[string]time.Duration{"Q": time.Minute, "QTA": time.Minute})
+    qid := bson.ObjectIdHex("53fb63a4472dcb6b32e99260")
+    uid := bson.ObjectIdHex("53fb63a4472dcb6b32e99261")
+    q := []string{"Q", qid.Hex()}
+    qta := []string{"QTA", qid.Hex(), "10", "0"}
+    answers := &[]model.Answer{{Qid: qid, Fuid: uid, Luid: uid}}
+    c.Put(q, []byte("{}"), true, cacheTags(q, &model.Question{ID: qid}))
+    c.Put(qta, []byte("[]"), true, cacheTags(qta, answers))
+
+    // a user rename invalidates only the entries embedding the user:
+    if n := c.Invalidate(uid.Hex()); n != 1 {
+        t.Error("expected 1 invalidated entry, got", n)
+    }
+    if _, _, found := c.Get(q); !found {
+        t.Error("Q should still be cached")
+    }
+    if n := c.Invalidate(qid.Hex()); n != 1 {
+        t.Error("expected 1 invalidated entry, got", n)
+    }
+    if c.Len() != 0 {
+        t.Error("expected an empty cache, got", c.Len())
+    }
+}
@@ -0,0 +1,509 @@
+// Package client is a Go client for the Denormalizer.
+// It takes care of the ZeroMQ framing of requests and replies, and decodes
+// the replies into the structs of the 'model' package.
+//
+// A Client keeps a pool of DEALER sockets and may be used by many goroutines
+// at once.
+//
+// The methods whose name ends with 'After' page through lists with cursors:
+// pass "" for the first page, then the cursor returned with the previous
+// page. The cursor returned with the last page is empty.
+package client
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/inSituo/Denormalizer/model"
+    zmq "github.com/pebbe/zmq4"
+    "gopkg.in/mgo.v2/bson"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Returned when the request succeeded, but the requested object does not
+// exist.
+var ErrEmpty = errors.New("denormalizer: empty reply")
+
+// Returned when no reply was received before the deadline of the call.
+var ErrTimeout = errors.New("denormalizer: request timed out")
+
+// Returned when the client was closed.
+var ErrClosed = errors.New("denormalizer: client closed")
+
+// A failure reply sent by the server. 'Code' is one of the model.ERR_*
+// error codes.
+type ServerError struct {
+    Code    string
+    Message string
+}
+
+func (e *ServerError) Error() string {
+    return "denormalizer: " + e.Code + ": " + e.Message
+}
+
+// Client options. Zero values are replaced by the defaults.
+type Options struct {
+    // Maximum number of idle sockets kept in the pool. Default: 4.
+    PoolSize int
+
+    // Timeout of one attempt, used when the call's context has no earlier
+    // deadline. Default: 5 seconds.
+    Timeout time.Duration
+
+    // How many times a request is sent again after a timeout or a socket
+    // error. Failure and empty replies are never retried. Default: 2. Set to
+    // a negative value to disable retries.
+    Retries int
+
+    // CURVE keys, Z85 encoded. Required by servers started with '-curvekey'.
+    // If the server does not accept the client's public key, the requests
+    // are not answered and the calls time out.
+    ServerKey string
+    PublicKey string
+    SecretKey string
+}
+
+type Client struct {
+    addr     string
+    context  *zmq.Context
+    timeout  time.Duration
+    retries  int
+    poolSize int
+
+    // CURVE keys, empty if CURVE is not used.
+    serverKey string
+    publicKey string
+    secretKey string
+
+    // Protects the idle sockets pool and the closed flag.
+    lock   sync.Mutex
+    idle   []*zmq.Socket
+    closed bool
+}
+
+// Construct a new client of the Denormalizer listening at 'addr', for
+// example "tcp://127.0.0.1:7710". 'opts' may be nil.
+func New(addr string, opts *Options) (*Client, error) {
+    o := Options{PoolSize: 4, Timeout: 5 * time.Second, Retries: 2}
+    if opts != nil {
+        o.ServerKey = opts.ServerKey
+        o.PublicKey = opts.PublicKey
+        o.SecretKey = opts.SecretKey
+        if opts.PoolSize > 0 {
+            o.PoolSize = opts.PoolSize
+        }
+        if opts.Timeout > 0 {
+            o.Timeout = opts.Timeout
+        }
+        if opts.Retries > 0 {
+            o.Retries = opts.Retries
+        } else if opts.Retries < 0 {
+            o.Retries = 0
+        }
+    }
+    context, err := zmq.NewContext()
+    if err != nil {
+        return nil, err
+    }
+    return &Client{
+        addr:      addr,
+        context:   context,
+        timeout:   o.Timeout,
+        retries:   o.Retries,
+        poolSize:  o.PoolSize,
+        serverKey: o.ServerKey,
+        publicKey: o.PublicKey,
+        secretKey: o.SecretKey,
+        idle:      make([]*zmq.Socket, 0, o.PoolSize),
+    }, nil
+}
+
+// Close the idle sockets and terminate the ZeroMQ context. Blocks until the
+// calls in progress are done.
+func (c *Client) Close() error {
+    c.lock.Lock()
+    c.closed = true
+    for _, soc := range c.idle {
+        soc.Close()
+    }
+    c.idle = nil
+    c.lock.Unlock()
+    return c.context.Term()
+}
+
+// Take an idle socket from the pool, or connect a new one.
+func (c *Client) socket() (*zmq.Socket, error) {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return nil, ErrClosed
+    }
+    if n := len(c.idle); n > 0 {
+        soc := c.idle[n-1]
+        c.idle = c.idle[:n-1]
+        c.lock.Unlock()
+        return soc, nil
+    }
+    c.lock.Unlock()
+
+    soc, err := c.context.NewSocket(zmq.DEALER)
+    if err != nil {
+        return nil, err
+    }
+    soc.SetLinger(0)
+    if c.serverKey != "" {
+        if err := soc.ClientAuthCurve(c.serverKey, c.publicKey, c.secretKey); err != nil {
+            soc.Close()
+            return nil, err
+        }
+    }
+    if err := soc.Connect(c.addr); err != nil {
+        soc.Close()
+        return nil, err
+    }
+    return soc, nil
+}
+
+// Return a socket to the pool, or close it if the pool is full.
+func (c *Client) release(soc *zmq.Socket) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.closed || len(c.idle) >= c.poolSize {
+        soc.Close()
+        return
+    }
+    c.idle = append(c.idle, soc)
+}
+
+// Send one request and wait for its reply, until the deadline.
+// On a timeout the socket is closed rather than returned to the pool, so a
+// late reply can't be mistaken for the reply of another request.
+func (c *Client) roundTrip(deadline time.Time, parts []string) ([]string, error) {
+    soc, err := c.socket()
+    if err != nil {
+        return nil, err
+    }
+    // DEALER sockets must send the empty delimiter a REQ socket would add:
+    msg := make([]interface{}, 0, len(parts)+1)
+    msg = append(msg, "")
+    for _, p := range parts {
+        msg = append(msg, p)
+    }
+    if _, err := soc.SendMessage(msg...); err != nil {
+        soc.Close()
+        return nil, err
+    }
+    poller := zmq.NewPoller()
+    poller.Add(soc, zmq.POLLIN)
+    polled, err := poller.Poll(time.Until(deadline))
+    if err != nil {
+        soc.Close()
+        return nil, err
+    }
+    if len(polled) == 0 {
+        soc.Close()
+        return nil, ErrTimeout
+    }
+    reply, err := soc.RecvMessage(0)
+    if err != nil {
+        soc.Close()
+        return nil, err
+    }
+    c.release(soc)
+    return reply, nil
+}
+
+// Send a raw request, made of the command name followed by its arguments,
+// and return the JSON payload of the reply.
+// Each attempt lasts until the context's deadline or the client's timeout,
+// whichever comes first. Timeouts and socket errors are retried as long as
+// the context is not done.
+func (c *Client) Do(ctx context.Context, parts ...string) ([]byte, error) {
+    reply, err := c.do(ctx, parts)
+    if err != nil {
+        return nil, err
+    }
+    return parseReply(reply)
+}
+
+// The reply of one command of a batch: its JSON payload, or an error.
+type BatchResult struct {
+    Payload []byte
+    Err     error
+}
+
+// Send several raw requests in one round trip. The server runs them in
+// parallel, and the results are returned in the order of 'cmds'. The error is
+// only set if the whole batch failed.
+func (c *Client) Batch(ctx context.Context, cmds ...[]string) ([]BatchResult, error) {
+    parts := []string{"BATCH"}
+    for _, cmd := range cmds {
+        parts = append(parts, strconv.Itoa(len(cmd)))
+        parts = append(parts, cmd...)
+    }
+    reply, err := c.do(ctx, parts)
+    if err != nil {
+        return nil, err
+    }
+    return parseBatchReply(reply, len(cmds))
+}
+
+// Send a request, retrying as described by 'Do', and return the reply parts.
+func (c *Client) do(ctx context.Context, parts []string) ([]string, error) {
+    var err error
+    for attempt := 0; attempt <= c.retries; attempt++ {
+        if ctxErr := ctx.Err(); ctxErr != nil {
+            if err == nil {
+                err = ctxErr
+            }
+            return nil, err
+        }
+        deadline := time.Now().Add(c.timeout)
+        if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+            deadline = d
+        }
+        // let the server drop the request once nobody waits for it:
+        ms := time.Until(deadline) / time.Millisecond
+        if ms < 1 {
+            ms = 1
+        }
+        timeout := fmt.Sprintf("@timeout=%d", ms)
+        var reply []string
+        reply, err = c.roundTrip(deadline, append(parts[:len(parts):len(parts)], timeout))
+        if err == nil {
+            return reply, nil
+        }
+        if err == ErrClosed {
+            return nil, err
+        }
+    }
+    return nil, err
+}
+
+// Parse the parts of a reply: the empty delimiter, success, empty and the
+// payload.
+func parseReply(reply []string) ([]byte, error) {
+    if len(reply) != 4 || reply[0] != "" {
+        return nil, fmt.Errorf("denormalizer: malformed reply %q", reply)
+    }
+    return parseResult(reply[1], reply[2], reply[3])
+}
+
+// Parse the parts of a batch reply: the empty delimiter, then success, empty
+// and payload for each of the 'n' commands. A batch which failed as a whole
+// is answered with a single failure.
+func parseBatchReply(reply []string, n int) ([]BatchResult, error) {
+    if len(reply) == 4 && reply[0] == "" && reply[1] != "true" && n != 1 {
+        _, err := parseResult(reply[1], reply[2], reply[3])
+        return nil, err
+    }
+    if len(reply) != 1+3*n || reply[0] != "" {
+        return nil, fmt.Errorf("denormalizer: malformed batch reply %q", reply)
+    }
+    results := make([]BatchResult, n)
+    for i := range results {
+        p := reply[1+3*i:]
+        results[i].Payload, results[i].Err = parseResult(p[0], p[1], p[2])
+    }
+    return results, nil
+}
+
+func parseResult(success, empty, payload string) ([]byte, error) {
+    if success != "true" {
+        var e model.Error
+        if err := json.Unmarshal([]byte(payload), &e); err != nil {
+            return nil, &ServerError{Code: model.ERR_INTERNAL, Message: payload}
+        }
+        return nil, &ServerError{Code: e.Code, Message: e.Message}
+    }
+    if empty == "true" {
+        return nil, ErrEmpty
+    }
+    return []byte(payload), nil
+}
+
+func (c *Client) get(ctx context.Context, v interface{}, parts ...string) error {
+    payload, err := c.Do(ctx, parts...)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(payload, v)
+}
+
+func (c *Client) list(
+    ctx context.Context,
+    v interface{},
+    cmd string,
+    id bson.ObjectId,
+    count, page int,
+) error {
+    return c.get(ctx, v, cmd, id.Hex(), strconv.Itoa(count), strconv.Itoa(page))
+}
+
+// The parts of a request for the command 'cmd' with the IDs as arguments.
+func hexIds(cmd string, ids []bson.ObjectId) []string {
+    parts := make([]string, 0, len(ids)+1)
+    parts = append(parts, cmd)
+    for _, id := range ids {
+        parts = append(parts, id.Hex())
+    }
+    return parts
+}
+
+// Get a page of a list after the cursor returned with the previous page, or
+// the first page if the cursor is empty. The items are decoded into 'v'.
+// Returns the cursor of the next page, empty after the last page.
+func (c *Client) listAfter(
+    ctx context.Context,
+    v interface{},
+    cmd string,
+    id bson.ObjectId,
+    count int,
+    cursor string,
+) (string, error) {
+    if cursor == "" {
+        cursor = "*"
+    }
+    page := model.Page{Items: v}
+    if err := c.get(ctx, &page, cmd, id.Hex(), strconv.Itoa(count), cursor); err != nil {
+        return "", err
+    }
+    return page.Next, nil
+}
+
+// Get a question. Returns ErrEmpty if it does not exist.
+func (c *Client) GetQuestion(ctx context.Context, id bson.ObjectId) (*model.Question, error) {
+    var q model.Question
+    if err := c.get(ctx, &q, "Q", id.Hex()); err != nil {
+        return nil, err
+    }
+    return &q, nil
+}
+
+// Get many questions in one request. The result has one entry per ID, in the
+// same order, nil if the question does not exist.
+func (c *Client) GetQuestions(ctx context.Context, ids ...bson.ObjectId) ([]*model.Question, error) {
+    var qs []*model.Question
+    if err := c.get(ctx, &qs, hexIds("QM", ids)...); err != nil {
+        return nil, err
+    }
+    return qs, nil
+}
+
+// Get a page of the users who joined a question.
+func (c *Client) GetQuestionJoins(ctx context.Context, id bson.ObjectId, count, page int) ([]model.QuestionJoin, error) {
+    var qjs []model.QuestionJoin
+    if err := c.list(ctx, &qjs, "QJ", id, count, page); err != nil {
+        return nil, err
+    }
+    return qjs, nil
+}
+
+// Same as 'GetQuestionJoins', but paged with cursors.
+func (c *Client) GetQuestionJoinsAfter(ctx context.Context, id bson.ObjectId, count int, cursor string) ([]model.QuestionJoin, string, error) {
+    qjs := []model.QuestionJoin{}
+    next, err := c.listAfter(ctx, &qjs, "QJ", id, count, cursor)
+    if err != nil {
+        return nil, "", err
+    }
+    return qjs, next, nil
+}
+
+// Get a page of the latest comments of a question.
+func (c *Client) GetQuestionLatestComments(ctx context.Context, id bson.ObjectId, count, page int) ([]model.Comment, error) {
+    var cmts []model.Comment
+    if err := c.list(ctx, &cmts, "QLC", id, count, page); err != nil {
+        return nil, err
+    }
+    return cmts, nil
+}
+
+// Same as 'GetQuestionLatestComments', but paged with cursors.
+func (c *Client) GetQuestionLatestCommentsAfter(ctx context.Context, id bson.ObjectId, count int, cursor string) ([]model.Comment, string, error) {
+    cmts := []model.Comment{}
+    next, err := c.listAfter(ctx, &cmts, "QLC", id, count, cursor)
+    if err != nil {
+        return nil, "", err
+    }
+    return cmts, next, nil
+}
+
+// Get a question with its top answers, latest comments and joins, in one
+// request. Returns ErrEmpty if the question does not exist.
+func (c *Client) GetQuestionPage(ctx context.Context, id bson.ObjectId, answers, comments, joins int) (*model.QuestionPage, error) {
+    var qp model.QuestionPage
+    if err := c.get(ctx, &qp, "QP", id.Hex(), strconv.Itoa(answers), strconv.Itoa(comments), strconv.Itoa(joins)); err != nil {
+        return nil, err
+    }
+    return &qp, nil
+}
+
+// Get a page of the revisions of a question, newest first. Returns ErrEmpty
+// if the question does not exist.
+func (c *Client) GetQuestionRevisions(ctx context.Context, id bson.ObjectId, count, page int) (*model.QuestionHistory, error) {
+    var qh model.QuestionHistory
+    if err := c.list(ctx, &qh, "QR", id, count, page); err != nil {
+        return nil, err
+    }
+    return &qh, nil
+}
+
+// Get an answer. Returns ErrEmpty if it does not exist.
+func (c *Client) GetAnswer(ctx context.Context, id bson.ObjectId) (*model.Answer, error) {
+    var a model.Answer
+    if err := c.get(ctx, &a, "A", id.Hex()); err != nil {
+        return nil, err
+    }
+    return &a, nil
+}
+
+// Get many answers in one request. The result has one entry per ID, in the
+// same order, nil if the answer does not exist.
+func (c *Client) GetAnswers(ctx context.Context, ids ...bson.ObjectId) ([]*model.Answer, error) {
+    var as []*model.Answer
+    if err := c.get(ctx, &as, hexIds("AM", ids)...); err != nil {
+        return nil, err
+    }
+    return as, nil
+}
+
+// Get a page of the top ranked answers of a question.
+func (c *Client) GetTopAnswers(ctx context.Context, qid bson.ObjectId, count, page int) ([]model.Answer, error) {
+    var as []model.Answer
+    if err := c.list(ctx, &as, "QTA", qid, count, page); err != nil {
+        return nil, err
+    }
+    return as, nil
+}
+
+// Same as 'GetTopAnswers', but paged with cursors.
+func (c *Client) GetTopAnswersAfter(ctx context.Context, qid bson.ObjectId, count int, cursor string) ([]model.Answer, string, error) {
+    as := []model.Answer{}
+    next, err := c.listAfter(ctx, &as, "QTA", qid, count, cursor)
+    if err != nil {
+        return nil, "", err
+    }
+    return as, next, nil
+}
+
+// Get a page of the latest answers of a question.
+func (c *Client) GetLatestAnswers(ctx context.Context, qid bson.ObjectId, count, page int) ([]model.Answer, error) {
+    var as []model.Answer
+    if err := c.list(ctx, &as, "QLA", qid, count, page); err != nil {
+        return nil, err
+    }
+    return as, nil
+}
+
+// Same as 'GetLatestAnswers', but paged with cursors.
+func (c *Client) GetLatestAnswersAfter(ctx context.Context, qid bson.ObjectId, count int, cursor string) ([]model.Answer, string, error) {
+    as := []model.Answer{}
+    next, err := c.listAfter(ctx, &as, "QLA", qid, count, cursor)
+    if err != nil {
+        return nil, "", err
+    }
+    return as, next, nil
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+    "github.com/inSituo/Denormalizer/model"
+    "testing"
+)
+
+func TestParseReply(t *testing.T) {
+    payload, err := parseReply([]string{"", "true", "false", `{"id":"53fb63a4472dcb6b32e99260"}`})
+    if err != nil || string(payload) != `{"id":"53fb63a4472dcb6b32e99260"}` {
+        t.Error("unexpected result", string(payload), err)
+    }
+    if _, err := parseReply([]string{"", "true", "true", ""}); err != ErrEmpty {
+        t.Error("expected ErrEmpty, got", err)
+    }
+    _, err = parseReply([]string{"", "false", "false", `{"code":"UNKNOWN_COMMAND","message":"Unknown command"}`})
+    if serr, ok := err.(*ServerError); !ok || serr.Code != model.ERR_UNKNOWN_COMMAND {
+        t.Error("expected a ServerError, got", err)
+    }
+    if _, err := parseReply([]string{"true", "false", "{}"}); err == nil {
+        t.Error("expected a malformed reply error")
+    }
+}
+
+func TestParseBatchReply(t *testing.T) {
+    results, err := parseBatchReply([]string{
+        "",
+        "true", "false", `{"id":"53fb63a4472dcb6b32e99260"}`,
+        "true", "true", "",
+        "false", "false", `{"code":"NOT_FOUND","message":"Unable to find user"}`,
+    }, 3)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(results[0].Payload) != `{"id":"53fb63a4472dcb6b32e99260"}` || results[0].Err != nil {
+        t.Error("unexpected first result", results[0])
+    }
+    if results[1].Err != ErrEmpty {
+        t.Error("expected ErrEmpty, got", results[1].Err)
+    }
+    if serr, ok := results[2].Err.(*ServerError); !ok || serr.Code != model.ERR_NOT_FOUND {
+        t.Error("expected a ServerError, got", results[2].Err)
+    }
+    // the whole batch failed:
+    _, err = parseBatchReply([]string{"", "false", "false", `{"code":"BAD_ARGS","message":"Empty batch"}`}, 2)
+    if serr, ok := err.(*ServerError); !ok || serr.Code != model.ERR_BAD_ARGS {
+        t.Error("expected a ServerError, got", err)
+    }
+    if _, err := parseBatchReply([]string{"", "true", "false"}, 1); err == nil {
+        t.Error("expected a malformed reply error")
+    }
+}
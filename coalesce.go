@@ -0,0 +1,100 @@
+package main
+
+import (
+    "sort"
+    "sync"
+)
+
+// The coalescer keeps track of the requests in flight, so that identical
+// requests (same command, arguments and options) which arrive while one of
+// them is being worked on are not executed again. They wait for the product
+// of the first one instead, and receive a copy of it.
+type Coalescer struct {
+    lock sync.Mutex
+
+    // The works waiting for the product of the work in flight, by key.
+    inflight map[string][]*Work
+}
+
+func NewCoalescer() *Coalescer {
+    return &Coalescer{
+        inflight: make(map[string][]*Work),
+    }
+}
+
+// The key under which a request is coalesced: its parameters and options.
+// The timeout option is left out, since it does not change the result.
+func requestKey(params []string, opts map[string]string) string {
+    key := cacheKey(params)
+    names := make([]string, 0, len(opts))
+    for name := range opts {
+        if name != "timeout" {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        key += "\x00" + OPTION_PREFIX + name + "=" + opts[name]
+    }
+    return key
+}
+
+// Register a work. Returns true if no identical work is in flight, in which
+// case the work must be executed and 'Done' called with it once its product
+// is ready. Otherwise the work waits for the product of the one in flight.
+func (c *Coalescer) Join(work *Work) bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    waiting, found := c.inflight[work.key]
+    if !found {
+        c.inflight[work.key] = []*Work{}
+        return true
+    }
+    c.inflight[work.key] = append(waiting, work)
+    coalesced.Add(1)
+    return false
+}
+
+// Mark an executed work as done. Returns the works which are waiting for
+// its product.
+func (c *Coalescer) Done(work *Work) []*Work {
+    waiting, _ := c.Release(work, nil)
+    return waiting
+}
+
+// Mark an executed work as done, unless some of the works waiting for it must
+// be done again: 'redo' tells which ones. The one with the latest deadline is
+// then returned, to be executed in place of the work, and the key stays in
+// flight: the other works keep waiting, along with the identical works which
+// arrive in the meantime.
+// Return:
+//  1. The works which get the product of the executed work
+//  2. The work to execute next, or nil if the key is done
+func (c *Coalescer) Release(work *Work, redo func(*Work) bool) ([]*Work, *Work) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    var waiting, again []*Work
+    for _, wk := range c.inflight[work.key] {
+        if redo != nil && redo(wk) {
+            again = append(again, wk)
+        } else {
+            waiting = append(waiting, wk)
+        }
+    }
+    if len(again) == 0 {
+        delete(c.inflight, work.key)
+        return waiting, nil
+    }
+    sort.Slice(again, func(i, j int) bool {
+        return again[i].deadline.After(again[j].deadline)
+    })
+    c.inflight[work.key] = again[1:]
+    return waiting, again[0]
+}
+
+// Number of keys in flight.
+func (c *Coalescer) Len() int {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return len(c.inflight)
+}
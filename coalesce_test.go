@@ -0,0 +1,123 @@
+package main
+
+import (
+    "github.com/inSituo/LeveledLogger"
+    "gopkg.in/mgo.v2"
+    "io/ioutil"
+    "testing"
+    "time"
+)
+
+func TestCoalescer(t *testing.T) {
+    c := NewCoalescer()
+    params := []string{"Q", "53fb63a4472dcb6b32e99260"}
+    first := &Work{id: []string{"a", ""}, key: requestKey(params, map[string]string{})}
+    second := &Work{id: []string{"b", ""}, key: requestKey(params, map[string]string{"timeout": "100"})}
+    other := &Work{id: []string{"c", ""}, key: requestKey(params, map[string]string{"nocache": ""})}
+    if !c.Join(first) {
+        t.Error("the first request must be executed")
+    }
+    if c.Join(second) {
+        t.Error("an identical request must wait for the first one")
+    }
+    if !c.Join(other) {
+        t.Error("a request with different options must be executed")
+    }
+    waiting := c.Done(first)
+    if len(waiting) != 1 || waiting[0] != second {
+        t.Error("unexpected waiting works", waiting)
+    }
+    c.Done(other)
+    if c.Len() != 0 {
+        t.Error("expected no requests in flight, got", c.Len())
+    }
+}
+
+func TestCoalescedTimeout(t *testing.T) {
+    params := []string{"Q", "53fb63a4472dcb6b32e99260"}
+    key := requestKey(params, map[string]string{})
+    work := func(id string, deadline time.Duration) *Work {
+        return &Work{id: []string{id, ""}, params: params, opts: map[string]string{}, key: key, deadline: time.Now().Add(deadline)}
+    }
+    w := &Worker{
+        cache:     NewCache(10, map[string]time.Duration{"Q": time.Minute}),
+        coalescer: NewCoalescer(),
+        log:       LeveledLogger.New(ioutil.Discard, LeveledLogger.LL_INFO),
+        prodq:     make(chan *Product, 10),
+    }
+    // the waiter's product comes from the cache, without the database:
+    w.cache.Put(params, []byte(`{"id":"53fb63a4472dcb6b32e99260"}`), true, nil)
+
+    // the first request expired in the buffer, but only one of the waiters:
+    expired, live, late := work("a", -time.Second), work("b", time.Minute), work("c", -time.Second)
+    for _, wk := range []*Work{expired, live, late} {
+        w.coalescer.Join(wk)
+    }
+    w.handle("test", expired)
+    prods := map[string]*Product{}
+    for i := 0; i < 3; i++ {
+        p := <-w.prodq
+        prods[p.id[0]] = p
+    }
+    if prods["a"].success || prods["c"].success {
+        t.Error("expected the expired requests to time out")
+    }
+    if !prods["b"].success || string(prods["b"].payload) != `{"id":"53fb63a4472dcb6b32e99260"}` {
+        t.Error("expected the live request to be done", prods["b"])
+    }
+    if w.coalescer.Len() != 0 {
+        t.Error("expected no requests in flight, got", w.coalescer.Len())
+    }
+}
+
+func TestCoalescedInflight(t *testing.T) {
+    // a command which runs until it is released:
+    calls := 0
+    started, release := make(chan bool), make(chan bool)
+    commands["SLOW"] = &Command{
+        Name: "SLOW",
+        Parse: func(s *Settings, params []string, opts map[string]string) (interface{}, error) {
+            return nil, nil
+        },
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            calls++
+            started <- true
+            <-release
+            return "done", true, nil
+        },
+    }
+    defer delete(commands, "SLOW")
+
+    params := []string{"SLOW"}
+    key := requestKey(params, map[string]string{})
+    work := func(id string) *Work {
+        return &Work{id: []string{id, ""}, params: params, opts: map[string]string{}, key: key, deadline: time.Now().Add(time.Minute)}
+    }
+    w := &Worker{
+        db:        &DB{session: &mgo.Session{}},
+        cache:     NewCache(10, map[string]time.Duration{}),
+        coalescer: NewCoalescer(),
+        log:       LeveledLogger.New(ioutil.Discard, LeveledLogger.LL_INFO),
+        prodq:     make(chan *Product, 10),
+    }
+    first, second := work("a"), work("b")
+    w.coalescer.Join(first)
+    go w.handle("test", first)
+
+    <-started
+    if w.coalescer.Join(second) {
+        t.Error("an identical request must wait for the one running")
+    }
+    close(release)
+    for i := 0; i < 2; i++ {
+        if p := <-w.prodq; !p.success || string(p.payload) != `"done"` {
+            t.Error("unexpected product", p)
+        }
+    }
+    if calls != 1 {
+        t.Error("expected the command to run once, got", calls)
+    }
+    if w.coalescer.Len() != 0 {
+        t.Error("expected no requests in flight, got", w.coalescer.Len())
+    }
+}
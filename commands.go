@@ -0,0 +1,106 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "sort"
+)
+
+// Types of command arguments, as listed by the 'HELP' command.
+const (
+    ARG_OID    = "oid"
+    ARG_INT    = "int"
+    ARG_FLOAT  = "float"
+    ARG_STRING = "string"
+)
+
+// An argument of a command, as sent by the client.
+type CommandArg struct {
+    Name string `json:"name"`
+    Type string `json:"type"`
+}
+
+// A command which can be requested by clients. Commands are registered with
+// 'RegisterCommand', usually from the 'init' function of the file which
+// implements them, and are executed by the workers.
+type Command struct {
+    // The name of the command, which is the first part of a request.
+    Name string `json:"name"`
+
+    // Short description of the command's result.
+    Desc string `json:"desc"`
+
+    // The arguments the command expects, in order.
+    Args []CommandArg `json:"args"`
+
+    // The request options which change the command's result. Results are
+    // cached separately for each value of these options.
+    Options []string `json:"options,omitempty"`
+
+    // Parses the request parts (including the command name) and options into
+    // the arguments passed to 'Handle', under the server's settings.
+    Parse func(s *Settings, params []string, opts map[string]string) (interface{}, error) `json:"-"`
+
+    // Executes the command with the parsed arguments.
+    // Return:
+    //  1. The result, which will be JSON encoded
+    //  2. (bool) Does the requested object exist?
+    //  3. (error) Nil or an error
+    Handle func(w *Worker, args interface{}) (interface{}, bool, error) `json:"-"`
+
+    // Tags of the cached results in addition to the IDs of the objects they
+    // are made of (see 'cacheTags'), for the changes which affect a result
+    // without changing its objects, such as new questions. Optional.
+    Tags func(params []string) []string `json:"-"`
+}
+
+var commands = make(map[string]*Command)
+
+// Register a command. Panics if a command with the same name is already
+// registered.
+func RegisterCommand(cmd *Command) {
+    if _, exists := commands[cmd.Name]; exists {
+        panic(fmt.Sprintf("command '%s' registered twice", cmd.Name))
+    }
+    if cmd.Args == nil {
+        cmd.Args = []CommandArg{}
+    }
+    commands[cmd.Name] = cmd
+}
+
+// All the registered commands, sorted by name.
+func Commands() []*Command {
+    cmds := make([]*Command, 0, len(commands))
+    for _, cmd := range commands {
+        cmds = append(cmds, cmd)
+    }
+    sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+    return cmds
+}
+
+func help(w *Worker, args interface{}) (interface{}, bool, error) {
+    return Commands(), true, nil
+}
+
+func init() {
+    RegisterCommand(&Command{
+        Name:   "HELP",
+        Desc:   "List of all the commands and their arguments",
+        Parse:  parseNoArgs,
+        Handle: help,
+    })
+    RegisterCommand(&Command{
+        Name:   "COMMANDS",
+        Desc:   "Same as HELP",
+        Parse:  parseNoArgs,
+        Handle: help,
+    })
+    RegisterCommand(&Command{
+        Name:  "STATS",
+        Desc:  "Server metrics",
+        Parse: parseNoArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            return json.RawMessage(stats.String()), true, nil
+        },
+    })
+}
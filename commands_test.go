@@ -0,0 +1,192 @@
+package main
+
+import (
+    "github.com/inSituo/Denormalizer/model"
+    "testing"
+)
+
+// The settings of the commands in the tests, built from the configuration
+// of the test server.
+var testSettings = func() *Settings {
+    s, err := newSettings(testConf())
+    if err != nil {
+        panic(err)
+    }
+    return s
+}()
+
+func TestCommandsRegistered(t *testing.T) {
+    for _, name := range []string{"Q", "QM", "QJ", "QLC", "QP", "QN", "QL", "QLP", "QS", "QR", "A", "AR", "U", "AM", "QTA", "QLA", "HELP", "STATS"} {
+        if _, found := commands[name]; !found {
+            t.Error("command not registered", name)
+        }
+    }
+    cmds := Commands()
+    for i := 1; i < len(cmds); i++ {
+        if cmds[i-1].Name >= cmds[i].Name {
+            t.Error("commands are not sorted", cmds[i-1].Name, cmds[i].Name)
+        }
+    }
+}
+
+func TestCommandParsers(t *testing.T) {
+    args, err := commands["QTA"].Parse(testSettings, []string{"QTA", "53fb63a4472dcb6b32e99260", "10", "2"}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if a := args.(oidCountPageArgs); a.id.Hex() != "53fb63a4472dcb6b32e99260" || a.count != 10 || a.page != 2 {
+        t.Error("unexpected arguments", a)
+    }
+    args, err = commands["QTA"].Parse(testSettings, []string{"QTA", "53fb63a4472dcb6b32e99260", "10", "2"}, map[string]string{"envelope": ""})
+    if err != nil || !args.(oidCountPageArgs).envelope {
+        t.Error("expected the envelope option", args, err)
+    }
+    // the page may be a cursor:
+    args, err = commands["QLC"].Parse(testSettings, []string{"QLC", "53fb63a4472dcb6b32e99260", "10", CURSOR_START}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if a := args.(oidCountPageArgs); a.cursor == nil || a.cursor.Cmd != "QLC" || a.page != 0 {
+        t.Error("unexpected arguments", a)
+    }
+    if _, err := commands["QLC"].Parse(testSettings, []string{"QLC", "53fb63a4472dcb6b32e99260", "0", CURSOR_START}, nil); err == nil {
+        t.Error("expected a zero count error")
+    }
+    // whose pages have no envelope:
+    if _, err := commands["QTA"].Parse(testSettings, []string{"QTA", "53fb63a4472dcb6b32e99260", "10", CURSOR_START}, map[string]string{"envelope": ""}); err == nil {
+        t.Error("expected an error for an envelope with a cursor")
+    }
+    // but a page which doesn't look like a cursor is a bad page number:
+    _, err = commands["QTA"].Parse(testSettings, []string{"QTA", "53fb63a4472dcb6b32e99260", "10", "x"}, nil)
+    if err == nil || asError(err).Message != "Third argument is not an integer" {
+        t.Error("expected a page number error, got", err)
+    }
+    if _, err := commands["Q"].Parse(testSettings, []string{"Q", "not-an-id"}, nil); err == nil {
+        t.Error("expected an invalid ObjectId error")
+    }
+    args, err = commands["QP"].Parse(testSettings, []string{"QP", "53fb63a4472dcb6b32e99260", "5", "0", "10"}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if a := args.(questionPageArgs); a.answers != 5 || a.comments != 0 || a.joins != 10 {
+        t.Error("unexpected arguments", a)
+    }
+    if _, err := commands["QP"].Parse(testSettings, []string{"QP", "53fb63a4472dcb6b32e99260", "5", "-1", "10"}, nil); err == nil {
+        t.Error("expected a negative count error")
+    }
+    args, err = commands["QM"].Parse(testSettings, []string{"QM", "53fb63a4472dcb6b32e99260", "53fb63a4472dcb6b32e99261"}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if a := args.(oidsArgs); len(a.ids) != 2 || a.ids[1].Hex() != "53fb63a4472dcb6b32e99261" {
+        t.Error("unexpected arguments", a)
+    }
+    args, err = commands["QN"].Parse(testSettings, []string{"QN", "32.08", "34.78", "500", "10", "1"}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if a := args.(geoCountPageArgs); a.lat != 32.08 || a.lon != 34.78 || a.radius != 500 || a.count != 10 || a.page != 1 {
+        t.Error("unexpected arguments", a)
+    }
+    for _, bad := range [][]string{
+        {"QN", "91", "34.78", "500", "10", "0"},
+        {"QN", "32.08", "34.78", "0", "10", "0"},
+        {"QN", "32.08", "34.78", "500", "10"},
+    } {
+        if _, err := commands["QN"].Parse(testSettings, bad, nil); err == nil {
+            t.Error("expected an error", bad)
+        }
+    }
+    args, err = commands["QL"].Parse(testSettings, []string{"QL", "/il/tel-aviv/", "10", "0", "joins"}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if a := args.(pathCountPageArgs); len(a.path) != 2 || a.path[1] != "tel-aviv" || a.sort != "joins" {
+        t.Error("unexpected arguments", a)
+    }
+    if _, err := commands["QL"].Parse(testSettings, []string{"QL", "il", "10", "0", "ranking"}, nil); err == nil {
+        t.Error("expected an unknown sort error")
+    }
+    if _, err := commands["QLP"].Parse(testSettings, []string{"QLP", "il//tel-aviv"}, nil); err == nil {
+        t.Error("expected an empty segment error")
+    }
+    args, err = commands["QLP"].Parse(testSettings, []string{"QLP", "/"}, nil)
+    if err != nil || len(args.([]string)) != 0 {
+        t.Error("expected the empty path", args, err)
+    }
+    args, err = commands["QS"].Parse(testSettings, []string{"QS", "parking", "10", "0"}, map[string]string{"path": "il/tel-aviv"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if a := args.(searchArgs); a.terms != "parking" || len(a.path) != 2 {
+        t.Error("unexpected arguments", a)
+    }
+    if _, err := commands["QS"].Parse(testSettings, []string{"QS", "-parking", "10", "0"}, nil); err == nil {
+        t.Error("expected a no search terms error")
+    }
+    args, err = commands["QR"].Parse(testSettings, []string{"QR", "53fb63a4472dcb6b32e99260", "10", "0"}, map[string]string{"diff": "0,2"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if a := args.(revisionsArgs); len(a.diff) != 2 || a.diff[0] != 0 || a.diff[1] != 2 {
+        t.Error("unexpected arguments", a)
+    }
+    if _, err := commands["QR"].Parse(testSettings, []string{"QR", "53fb63a4472dcb6b32e99260", "10", "0"}, map[string]string{"diff": "1"}); err == nil {
+        t.Error("expected an invalid diff error")
+    }
+    if _, err := commands["AR"].Parse(testSettings, []string{"AR", "53fb63a4472dcb6b32e99260", "10", "0"}, map[string]string{"diff": "0,2"}); err == nil {
+        t.Error("expected AR to reject the diff option")
+    }
+    ids := []string{"AM"}
+    for i := 0; i <= testSettings.maxIds; i++ {
+        ids = append(ids, "53fb63a4472dcb6b32e99260")
+    }
+    if _, err := commands["AM"].Parse(testSettings, ids, nil); err == nil {
+        t.Error("expected a too many IDs error")
+    }
+    if _, err := commands["AM"].Parse(testSettings, []string{"AM"}, nil); err == nil {
+        t.Error("expected an incorrect number of arguments error")
+    }
+    if _, err := commands["HELP"].Parse(testSettings, []string{"HELP", "extra"}, nil); err == nil {
+        t.Error("expected an incorrect number of arguments error")
+    }
+}
+
+func TestCountPageArgs(t *testing.T) {
+    cases := []struct {
+        params  []string
+        message string
+    }{
+        {[]string{"QJ", "53fb63a4472dcb6b32e99260", "10"}, "Incorrect number of arguments"},
+        {[]string{"QJ", "53fb63a4472dcb6b32e99260", "ten", "0"}, "Second argument is not an integer"},
+        {[]string{"QJ", "53fb63a4472dcb6b32e99260", "0", "0"}, "Second argument is not a positive integer"},
+        {[]string{"QLC", "53fb63a4472dcb6b32e99260", "-5", "0"}, "Second argument is not a positive integer"},
+        {[]string{"QTA", "53fb63a4472dcb6b32e99260", "10", "-1"}, "Third argument is not a non-negative integer"},
+        {[]string{"QR", "53fb63a4472dcb6b32e99260", "0", "0"}, "Second argument is not a positive integer"},
+        {[]string{"QR", "53fb63a4472dcb6b32e99260", "10", "-1"}, "Third argument is not a non-negative integer"},
+    }
+    for _, c := range cases {
+        _, err := commands[c.params[0]].Parse(testSettings, c.params, nil)
+        if err == nil || asError(err).Code != model.ERR_BAD_ARGS || asError(err).Message != c.message {
+            t.Error(c.params, "expected", c.message, "got", err)
+        }
+    }
+    if _, err := commands["QJ"].Parse(testSettings, []string{"QJ", "53fb63a4472dcb6b32e99260", "1", "0"}, nil); err != nil {
+        t.Error("unexpected error", err)
+    }
+}
+
+func TestCacheParams(t *testing.T) {
+    // options which change the result are part of the cache key:
+    work := &Work{
+        params: []string{"QLC", "53fb63a4472dcb6b32e99260", "10", "0"},
+        opts:   map[string]string{"envelope": "", "timeout": "250"},
+    }
+    if p := cacheParams(work); len(p) != 5 || p[4] != "@envelope=" {
+        t.Error("unexpected cache params", p)
+    }
+    work.opts = map[string]string{"nocache": ""}
+    if p := cacheParams(work); len(p) != 4 {
+        t.Error("unexpected cache params", p)
+    }
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "gopkg.in/mgo.v2/bson"
+    "strings"
+)
+
+const (
+    // Passed instead of a page number to get the first page of a list with
+    // a cursor.
+    CURSOR_START = "*"
+
+    // Length of the truncated HMAC of a cursor, in bytes.
+    CURSOR_MAC_LEN = 16
+)
+
+// A position in a list, after which the next page of the list starts.
+// Cursors are sent to clients as opaque strings, signed with the key of the
+// '-secretfile' so that clients can't forge them, see 'encodeCursor'.
+type Cursor struct {
+    // The command listing the items, and the object whose items are listed.
+    // A cursor is only valid for the same command and object.
+    Cmd string        `json:"c"`
+    ID  bson.ObjectId `json:"o"`
+
+    // The sort key and the ID of the last item of the previous page. Lists
+    // are sorted by descending key, then by descending ID. 'Last' is empty
+    // for the first page.
+    Key  int           `json:"k"`
+    Last bson.ObjectId `json:"l,omitempty"`
+}
+
+// Does the cursor point to the first page?
+func (c *Cursor) start() bool {
+    return c.Last == ""
+}
+
+// The query condition matching the items which come after the cursor, in a
+// list sorted by descending 'field', then by descending ID.
+func (c *Cursor) after(field string) []bson.M {
+    return []bson.M{
+        {field: bson.M{"$lt": c.Key}},
+        {field: c.Key, "_id": bson.M{"$lt": c.Last}},
+    }
+}
+
+// The key signing the cursors: 'secret', or a random key if it's empty, so
+// the cursors are only valid until the server restarts.
+func cursorKey(secret string) ([]byte, error) {
+    if secret != "" {
+        return []byte(secret), nil
+    }
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        return nil, err
+    }
+    return key, nil
+}
+
+func (st *Settings) signCursor(data string) []byte {
+    mac := hmac.New(sha256.New, st.cursorKey)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)[:CURSOR_MAC_LEN]
+}
+
+// Does the argument look like a cursor rather than a page number? Cursors
+// are CURSOR_START or contain the '.' between their payload and their mac.
+func isCursor(s string) bool {
+    return s == CURSOR_START || strings.Contains(s, ".")
+}
+
+// Encode a cursor as '<payload>.<mac>', both base64 (URL safe) encoded.
+func (st *Settings) encodeCursor(c *Cursor) (string, error) {
+    data, err := json.Marshal(c)
+    if err != nil {
+        return "", err
+    }
+    payload := base64.RawURLEncoding.EncodeToString(data)
+    return payload + "." + base64.RawURLEncoding.EncodeToString(st.signCursor(payload)), nil
+}
+
+// Decode a cursor sent by a client, and check its signature.
+func (st *Settings) decodeCursor(s string) (*Cursor, error) {
+    invalid := badArgs("Invalid cursor")
+    i := strings.Index(s, ".")
+    if i < 0 {
+        return nil, invalid
+    }
+    mac, err := base64.RawURLEncoding.DecodeString(s[i+1:])
+    if err != nil || !hmac.Equal(mac, st.signCursor(s[:i])) {
+        return nil, invalid
+    }
+    data, err := base64.RawURLEncoding.DecodeString(s[:i])
+    if err != nil {
+        return nil, invalid
+    }
+    var c Cursor
+    if err := json.Unmarshal(data, &c); err != nil {
+        return nil, invalid
+    }
+    return &c, nil
+}
+
+// Parse the cursor argument of the command 'cmd' listing the items of the
+// object 'id': either CURSOR_START, or a cursor returned by the previous page
+// of the same list.
+func (st *Settings) parseCursor(s, cmd string, id bson.ObjectId) (*Cursor, error) {
+    if s == CURSOR_START {
+        return &Cursor{Cmd: cmd, ID: id}, nil
+    }
+    c, err := st.decodeCursor(s)
+    if err != nil {
+        return nil, err
+    }
+    if c.Cmd != cmd || c.ID != id {
+        return nil, badArgs("Cursor belongs to another list")
+    }
+    return c, nil
+}
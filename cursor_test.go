@@ -0,0 +1,63 @@
+package main
+
+import (
+    "gopkg.in/mgo.v2/bson"
+    "strings"
+    "testing"
+)
+
+func TestCursor(t *testing.T) {
+    st := &Settings{cursorKey: []byte("test")}
+    qid, cid := bson.NewObjectId(), bson.NewObjectId()
+    s, err := st.encodeCursor(&Cursor{Cmd: "QLC", ID: qid, Key: 1408984000, Last: cid})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !isCursor(s) || !isCursor(CURSOR_START) || isCursor("x") {
+        t.Error("unexpected cursor shapes")
+    }
+
+    c, err := st.parseCursor(s, "QLC", qid)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if c.Key != 1408984000 || c.Last != cid || c.start() {
+        t.Error("unexpected cursor", c)
+    }
+    if c, err := st.parseCursor(CURSOR_START, "QTA", qid); err != nil || !c.start() || c.Cmd != "QTA" {
+        t.Error("unexpected start cursor", c, err)
+    }
+    // cursors are bound to their list:
+    if _, err := st.parseCursor(s, "QLA", qid); err == nil {
+        t.Error("expected an error for another command")
+    }
+    if _, err := st.parseCursor(s, "QLC", bson.NewObjectId()); err == nil {
+        t.Error("expected an error for another question")
+    }
+    // and can't be forged:
+    payload := s[:strings.Index(s, ".")]
+    if _, err := st.decodeCursor(payload + "." + "AAAAAAAAAAAAAAAAAAAAAA"); err == nil {
+        t.Error("expected an error for a bad signature")
+    }
+    another := &Settings{cursorKey: []byte("another")}
+    if _, err := another.decodeCursor(s); err == nil {
+        t.Error("expected an error for another secret")
+    }
+    for _, bad := range []string{"", "garbage", "a.b.c"} {
+        if _, err := st.decodeCursor(bad); err == nil {
+            t.Error("expected an error", bad)
+        }
+    }
+    // without a secret, the key is random:
+    if k1, k2 := mustKey(t, ""), mustKey(t, ""); len(k1) != 32 || string(k1) == string(k2) {
+        t.Error("unexpected random keys")
+    }
+}
+
+func mustKey(t *testing.T, secret string) []byte {
+    key, err := cursorKey(secret)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return key
+}
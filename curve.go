@@ -0,0 +1,209 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "github.com/inSituo/LeveledLogger"
+    zmq "github.com/pebbe/zmq4"
+    "io/ioutil"
+    "os"
+    "strings"
+    "sync"
+)
+
+const (
+    // The ZAP domain of the frontend socket.
+    CURVE_DOMAIN = "denormalizer"
+
+    // The endpoint of the ZAP handler. Fixed by the ZAP protocol; each
+    // ZeroMQ context has its own.
+    ZAP_ADDR = "inproc://zeromq.zap.01"
+
+    // Length of a Z85 encoded CURVE key.
+    CURVE_KEY_LEN = 40
+)
+
+// CURVE encryption and client authentication for the frontend socket.
+// The server's secret key is loaded from a file, and clients are only
+// accepted if their public key is listed in the clients file. The list can
+// be reloaded while the server runs.
+//
+// Authentication is done by a ZAP handler running in the server's context.
+type Curve struct {
+    log *LeveledLogger.Logger
+
+    // The server's Z85 encoded secret key.
+    secret string
+
+    clientsFile string
+
+    // Protects 'allowed', which is read by the ZAP handler and replaced by
+    // 'Reload'.
+    lock sync.RWMutex
+
+    // The raw (not Z85 encoded) public keys of the allowed clients.
+    allowed map[string]bool
+}
+
+// Load the server's secret key and the allowed clients' public keys.
+func NewCurve(keyFile, clientsFile string, ll_level int) (*Curve, error) {
+    secret, err := readKey(keyFile)
+    if err != nil {
+        return nil, err
+    }
+    c := &Curve{
+        log:         LeveledLogger.New(os.Stdout, ll_level),
+        secret:      secret,
+        clientsFile: clientsFile,
+    }
+    if err := c.Reload(); err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+// Read the allowed clients' public keys again from the clients file.
+// Connected clients stay connected; the new list applies to new connections.
+func (c *Curve) Reload() error {
+    keys, err := readKeys(c.clientsFile)
+    if err != nil {
+        return err
+    }
+    allowed := make(map[string]bool, len(keys))
+    for _, key := range keys {
+        allowed[zmq.Z85decode(key)] = true
+    }
+    c.lock.Lock()
+    c.allowed = allowed
+    c.lock.Unlock()
+    c.log.Info("Curve.Reload", "allowed clients loaded", len(allowed))
+    return nil
+}
+
+func (c *Curve) isAllowed(key string) bool {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    return c.allowed[key]
+}
+
+// Make the socket a CURVE server. Must be called before the socket is bound.
+func (c *Curve) Apply(soc *zmq.Socket) error {
+    if err := soc.SetZapDomain(CURVE_DOMAIN); err != nil {
+        return err
+    }
+    if err := soc.SetCurveServer(1); err != nil {
+        return err
+    }
+    return soc.SetCurveSecretkey(c.secret)
+}
+
+// Bind the ZAP handler socket in the context. Must be done before any CURVE
+// server socket of the context is bound.
+func (c *Curve) Bind(context *zmq.Context) (*zmq.Socket, error) {
+    handler, err := context.NewSocket(zmq.REP)
+    if err != nil {
+        return nil, err
+    }
+    if err := handler.Bind(ZAP_ADDR); err != nil {
+        handler.Close()
+        return nil, err
+    }
+    return handler, nil
+}
+
+// Answer ZAP requests on the handler socket until the context is terminated.
+func (c *Curve) Run(handler *zmq.Socket) {
+    iname := "Curve.Run"
+    defer handler.Close()
+    for {
+        req, err := handler.RecvMessage(0)
+        if err != nil {
+            if zmq.AsErrno(err) == zmq.ETERM {
+                return
+            }
+            c.log.Warn(iname, "failed to receive ZAP request", err)
+            continue
+        }
+        // the REP socket must reply before it can receive again, even to a
+        // malformed request:
+        if _, err := handler.SendMessage(c.zapReply(req)); err != nil {
+            c.log.Warn(iname, "failed to send ZAP reply", err)
+        }
+    }
+}
+
+// The reply to a ZAP request: version, request id, status code, status text,
+// user id and metadata. Malformed requests are rejected like unknown clients.
+func (c *Curve) zapReply(req []string) []string {
+    iname := "Curve.zapReply"
+    // version, request id, domain, address, identity, mechanism,
+    // credentials...
+    if len(req) < 6 {
+        c.log.Warn(iname, "malformed ZAP request", len(req))
+        id := ""
+        if len(req) > 1 {
+            id = req[1]
+        }
+        return []string{"1.0", id, "400", "malformed request", "", ""}
+    }
+    status, text := "400", "unknown client"
+    if req[0] == "1.0" && req[5] == "CURVE" && len(req) == 7 && c.isAllowed(req[6]) {
+        status, text = "200", "OK"
+    } else {
+        c.log.Warn(iname, "client rejected", req[3], zmq.Z85encode(req[len(req)-1]))
+    }
+    return []string{"1.0", req[1], status, text, "", ""}
+}
+
+// Read a Z85 encoded key from the first line of a file.
+func readKey(path string) (string, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return "", err
+    }
+    key := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+    if len(key) != CURVE_KEY_LEN {
+        return "", fmt.Errorf("%s: not a Z85 encoded CURVE key", path)
+    }
+    return key, nil
+}
+
+// Read Z85 encoded keys from a file, one per line. Empty lines and lines
+// starting with '#' are skipped.
+func readKeys(path string) ([]string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    keys := make([]string, 0)
+    scanner := bufio.NewScanner(f)
+    for n := 1; scanner.Scan(); n++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if len(line) != CURVE_KEY_LEN {
+            return nil, fmt.Errorf("%s:%d: not a Z85 encoded CURVE key", path, n)
+        }
+        keys = append(keys, line)
+    }
+    return keys, scanner.Err()
+}
+
+// Generate a new CURVE keypair and write it to '<name>.key' (the secret key,
+// readable by the owner only) and '<name>.pub' (the public key).
+func GenerateKeypair(name string) error {
+    public, secret, err := zmq.NewCurveKeypair()
+    if err != nil {
+        return err
+    }
+    if public == "" || secret == "" {
+        return errors.New("ZeroMQ was built without CURVE support")
+    }
+    if err := ioutil.WriteFile(name+".key", []byte(secret+"\n"), 0600); err != nil {
+        return err
+    }
+    return ioutil.WriteFile(name+".pub", []byte(public+"\n"), 0644)
+}
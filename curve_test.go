@@ -0,0 +1,79 @@
+package main
+
+import (
+    "github.com/inSituo/LeveledLogger"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+const (
+    testPublicKey = "Yne@$w-vo<fVvi]a<NY6T1ed:M$fCG*[IaLV{hID"
+    testSecretKey = "D:)Q[IlAW!ahhC2ac:9*A}h:p?([4%wOTJ%JR%cs"
+)
+
+func writeTemp(t *testing.T, dir, name, content string) string {
+    path := filepath.Join(dir, name)
+    if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestReadKeys(t *testing.T) {
+    dir, err := ioutil.TempDir("", "curve")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    path := writeTemp(t, dir, "server.key", testSecretKey+"\n")
+    if key, err := readKey(path); err != nil || key != testSecretKey {
+        t.Error("unexpected key", key, err)
+    }
+    path = writeTemp(t, dir, "bad.key", "not a key\n")
+    if _, err := readKey(path); err == nil {
+        t.Error("expected an error for a malformed key")
+    }
+
+    path = writeTemp(t, dir, "clients", "# allowed clients\n\n"+testPublicKey+"\n  "+testSecretKey+"  \n")
+    keys, err := readKeys(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(keys, []string{testPublicKey, testSecretKey}) {
+        t.Error("unexpected keys", keys)
+    }
+    path = writeTemp(t, dir, "badclients", testPublicKey+"\nshort\n")
+    if _, err := readKeys(path); err == nil {
+        t.Error("expected an error for a malformed key")
+    }
+}
+
+func TestZapReply(t *testing.T) {
+    c := &Curve{
+        log:     LeveledLogger.New(ioutil.Discard, LeveledLogger.LL_INFO),
+        allowed: map[string]bool{"allowed": true},
+    }
+    request := func(key string) []string {
+        return []string{"1.0", "7", CURVE_DOMAIN, "127.0.0.1", "", "CURVE", key}
+    }
+    if r := c.zapReply(request("allowed")); r[1] != "7" || r[2] != "200" {
+        t.Error("expected the client to be accepted", r)
+    }
+    if r := c.zapReply(request("other")); r[1] != "7" || r[2] != "400" {
+        t.Error("expected the client to be rejected", r)
+    }
+    // malformed requests get a reply too, or the socket can't receive again:
+    for _, req := range [][]string{{}, {"1.0"}, {"1.0", "7", CURVE_DOMAIN}} {
+        r := c.zapReply(req)
+        if len(r) != 6 || r[2] != "400" {
+            t.Error("expected a rejection", req, r)
+        }
+    }
+    if r := c.zapReply([]string{"1.0", "7"}); r[1] != "7" {
+        t.Error("expected the request id", r)
+    }
+}
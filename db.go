@@ -3,6 +3,9 @@ package main
 import (
     "fmt"
     "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+    "net"
+    "time"
 )
 
 type MongoConf struct {
@@ -22,6 +25,7 @@ type DB struct {
     Comments  *mgo.Collection
     session   *mgo.Session
     conf      *MongoConf
+    deadline  time.Time
 }
 
 func NewDB(conf *MongoConf) (*DB, error) {
@@ -61,3 +65,135 @@ func (db *DB) Copy() *DB {
 func (db *DB) Close() {
     db.session.Close()
 }
+
+// The MongoDB oplog. Only replica set members have one.
+func (db *DB) Oplog() *mgo.Collection {
+    return db.session.DB("local").C("oplog.rs")
+}
+
+// Bound the following database operations by the deadline. Reads from the
+// database socket time out when the deadline passes. Queries which support
+// it should also be limited with 'MaxTime', so the server gives up as well,
+// and aggregations run with 'DB.Pipe'.
+func (db *DB) SetDeadline(deadline time.Time) {
+    db.deadline = deadline
+    db.session.SetSocketTimeout(db.MaxTime())
+}
+
+// The time left before the deadline.
+func (db *DB) MaxTime() time.Duration {
+    left := db.deadline.Sub(time.Now())
+    if left < time.Millisecond {
+        left = time.Millisecond
+    }
+    return left
+}
+
+// An aggregation pipeline bounded by the deadline: unlike mgo's 'Pipe', its
+// command carries 'maxTimeMS', so the server gives up when the deadline
+// passes. See 'DB.Pipe'.
+type Pipe struct {
+    db         *DB
+    collection *mgo.Collection
+    pipeline   interface{}
+    allowDisk  bool
+}
+
+// Prepare an aggregation pipeline on the collection, limited to 'MaxTime'.
+// It's used like the collection's 'Pipe'.
+func (db *DB) Pipe(c *mgo.Collection, pipeline interface{}) *Pipe {
+    return &Pipe{db: db, collection: c, pipeline: pipeline}
+}
+
+// Let the stages of the pipeline write temporary files, for sorts and
+// groups over the server's memory limit (100MB).
+func (p *Pipe) AllowDiskUse() *Pipe {
+    p.allowDisk = true
+    return p
+}
+
+// The aggregate command of the pipeline.
+func (p *Pipe) command() bson.D {
+    cmd := bson.D{
+        {Name: "aggregate", Value: p.collection.Name},
+        {Name: "pipeline", Value: p.pipeline},
+        {Name: "cursor", Value: bson.M{}},
+        {Name: "maxTimeMS", Value: int64(p.db.MaxTime() / time.Millisecond)},
+    }
+    if p.allowDisk {
+        cmd = append(cmd, bson.DocElem{Name: "allowDiskUse", Value: true})
+    }
+    return cmd
+}
+
+// Run the pipeline and iterate over its results.
+func (p *Pipe) Iter() *mgo.Iter {
+    c := p.collection
+    var res struct {
+        Cursor struct {
+            FirstBatch []bson.Raw `bson:"firstBatch"`
+            ID         int64      `bson:"id"`
+        } `bson:"cursor"`
+    }
+    err := c.Database.Run(p.command(), &res)
+    return c.NewIter(nil, res.Cursor.FirstBatch, res.Cursor.ID, err)
+}
+
+// Run the pipeline and unmarshal all its results.
+func (p *Pipe) All(result interface{}) error {
+    return p.Iter().All(result)
+}
+
+// Run the pipeline and unmarshal its first result. Returns mgo.ErrNotFound
+// if there are no results.
+func (p *Pipe) One(result interface{}) error {
+    iter := p.Iter()
+    if iter.Next(result) {
+        return iter.Close()
+    }
+    if err := iter.Close(); err != nil {
+        return err
+    }
+    return mgo.ErrNotFound
+}
+
+// Reset the session after an error, so the next operation gets a fresh
+// socket instead of the one which timed out.
+func (db *DB) Refresh() {
+    db.session.Refresh()
+}
+
+// Does the collection have an index of the kind (such as "2dsphere") on the
+// field?
+func HasIndex(c *mgo.Collection, kind, field string) (bool, error) {
+    indexes, err := c.Indexes()
+    if err != nil {
+        return false, err
+    }
+    return hasIndexKey(indexes, kind, field), nil
+}
+
+func hasIndexKey(indexes []mgo.Index, kind, field string) bool {
+    // mgo lists the keys of special indexes as "$kind:field":
+    key := "$" + kind + ":" + field
+    for _, index := range indexes {
+        for _, k := range index.Key {
+            if k == key {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Did the operation fail because the deadline passed?
+func IsTimeout(err error) bool {
+    if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+        return true
+    }
+    // the server's "operation exceeded time limit" error:
+    if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 50 {
+        return true
+    }
+    return false
+}
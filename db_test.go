@@ -0,0 +1,28 @@
+package main
+
+import (
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+    "testing"
+    "time"
+)
+
+func TestPipeMaxTime(t *testing.T) {
+    db := &DB{}
+    db.deadline = time.Now().Add(time.Second)
+    c := &mgo.Collection{Name: "questions"}
+    cmd := db.Pipe(c, []bson.M{}).command()
+    if cmd[0].Name != "aggregate" || cmd[0].Value != "questions" {
+        t.Error("unexpected command", cmd)
+    }
+    ms := cmd.Map()["maxTimeMS"].(int64)
+    if ms <= 0 || ms > 1000 {
+        t.Error("unexpected time limit", ms)
+    }
+    if _, ok := cmd.Map()["allowDiskUse"]; ok {
+        t.Error("unexpected disk use", cmd)
+    }
+    if cmd := db.Pipe(c, []bson.M{}).AllowDiskUse().command(); cmd.Map()["allowDiskUse"] != true {
+        t.Error("expected disk use", cmd)
+    }
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+    "github.com/inSituo/Denormalizer/model"
+    "strings"
+)
+
+// Texts whose numbers of lines multiply to more than this are not compared
+// line by line: all the old lines are deleted and all the new ones inserted.
+const DIFF_MAX_CELLS = 1000000
+
+// The line-level differences between two texts, from the longest common
+// subsequence of their lines.
+func lineDiff(a, b string) []model.DiffLine {
+    al, bl := strings.Split(a, "\n"), strings.Split(b, "\n")
+    diff := make([]model.DiffLine, 0, len(al)+len(bl))
+    if len(al)*len(bl) > DIFF_MAX_CELLS {
+        for _, l := range al {
+            diff = append(diff, model.DiffLine{Op: model.DIFF_DELETE, Text: l})
+        }
+        for _, l := range bl {
+            diff = append(diff, model.DiffLine{Op: model.DIFF_INSERT, Text: l})
+        }
+        return diff
+    }
+    // lcs[i][j] is the length of the LCS of al[i:] and bl[j:]
+    lcs := make([][]int, len(al)+1)
+    for i := range lcs {
+        lcs[i] = make([]int, len(bl)+1)
+    }
+    for i := len(al) - 1; i >= 0; i-- {
+        for j := len(bl) - 1; j >= 0; j-- {
+            if al[i] == bl[j] {
+                lcs[i][j] = lcs[i+1][j+1] + 1
+            } else if lcs[i+1][j] >= lcs[i][j+1] {
+                lcs[i][j] = lcs[i+1][j]
+            } else {
+                lcs[i][j] = lcs[i][j+1]
+            }
+        }
+    }
+    i, j := 0, 0
+    for i < len(al) && j < len(bl) {
+        switch {
+        case al[i] == bl[j]:
+            diff = append(diff, model.DiffLine{Op: model.DIFF_EQUAL, Text: al[i]})
+            i++
+            j++
+        case lcs[i+1][j] >= lcs[i][j+1]:
+            diff = append(diff, model.DiffLine{Op: model.DIFF_DELETE, Text: al[i]})
+            i++
+        default:
+            diff = append(diff, model.DiffLine{Op: model.DIFF_INSERT, Text: bl[j]})
+            j++
+        }
+    }
+    for ; i < len(al); i++ {
+        diff = append(diff, model.DiffLine{Op: model.DIFF_DELETE, Text: al[i]})
+    }
+    for ; j < len(bl); j++ {
+        diff = append(diff, model.DiffLine{Op: model.DIFF_INSERT, Text: bl[j]})
+    }
+    return diff
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+    "github.com/inSituo/Denormalizer/model"
+    "testing"
+)
+
+func TestLineDiff(t *testing.T) {
+    diff := lineDiff("a\nb\nc\nd", "a\nc\nx\nd")
+    want := []model.DiffLine{
+        {Op: model.DIFF_EQUAL, Text: "a"},
+        {Op: model.DIFF_DELETE, Text: "b"},
+        {Op: model.DIFF_EQUAL, Text: "c"},
+        {Op: model.DIFF_INSERT, Text: "x"},
+        {Op: model.DIFF_EQUAL, Text: "d"},
+    }
+    if len(diff) != len(want) {
+        t.Fatal("unexpected diff", diff)
+    }
+    for i := range want {
+        if diff[i] != want[i] {
+            t.Error("unexpected line", i, diff[i], want[i])
+        }
+    }
+    if diff := lineDiff("same", "same"); len(diff) != 1 || diff[0].Op != model.DIFF_EQUAL {
+        t.Error("unexpected diff", diff)
+    }
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "fmt"
+    "hash/fnv"
+)
+
+// A dispatch strategy selects the worker which will handle a work item.
+// Strategies are only called from the dispatcher goroutine, so they don't
+// need to be safe for concurrent use.
+type Dispatcher interface {
+    Select(work *Work, workers []*Worker) *Worker
+}
+
+// Names of the available dispatch strategies, as accepted by the
+// '-dispatch' flag.
+const (
+    DISPATCH_LEAST_LOADED = "least-loaded"
+    DISPATCH_ROUND_ROBIN  = "round-robin"
+    DISPATCH_HASH         = "hash"
+)
+
+// Construct the dispatch strategy with the given name.
+func NewDispatcher(name string) (Dispatcher, error) {
+    switch name {
+    case DISPATCH_LEAST_LOADED:
+        return &leastLoadedDispatcher{}, nil
+    case DISPATCH_ROUND_ROBIN:
+        return &roundRobinDispatcher{}, nil
+    case DISPATCH_HASH:
+        return &hashDispatcher{}, nil
+    }
+    return nil, fmt.Errorf("unknown dispatch strategy '%s'", name)
+}
+
+// Selects the worker which has the least items in its buffer.
+type leastLoadedDispatcher struct{}
+
+func (d *leastLoadedDispatcher) Select(work *Work, workers []*Worker) *Worker {
+    selected := workers[0]
+    for _, w := range workers[1:] {
+        if w.QueueDepth() < selected.QueueDepth() {
+            selected = w
+        }
+    }
+    return selected
+}
+
+// Selects the workers one after the other.
+type roundRobinDispatcher struct {
+    next int
+}
+
+func (d *roundRobinDispatcher) Select(work *Work, workers []*Worker) *Worker {
+    selected := workers[d.next%len(workers)]
+    d.next = (d.next + 1) % len(workers)
+    return selected
+}
+
+// Selects the worker by hashing the object ID of the request, so repeated
+// queries for the same object land on the same worker.
+// Requests without arguments are hashed by the command name.
+type hashDispatcher struct{}
+
+func (d *hashDispatcher) Select(work *Work, workers []*Worker) *Worker {
+    key := work.params[0]
+    if len(work.params) > 1 {
+        key = work.params[1]
+    }
+    h := fnv.New32a()
+    h.Write([]byte(key))
+    return workers[h.Sum32()%uint32(len(workers))]
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "testing"
+)
+
+func testWorkers(depths ...int) []*Worker {
+    workers := make([]*Worker, len(depths))
+    for i, depth := range depths {
+        workers[i] = &Worker{ID: i, workq: make(chan *Work, 10)}
+        for j := 0; j < depth; j++ {
+            workers[i].workq <- &Work{}
+        }
+    }
+    return workers
+}
+
+func TestLeastLoadedDispatcher(t *testing.T) {
+    d, _ := NewDispatcher(DISPATCH_LEAST_LOADED)
+    work := &Work{params: []string{"Q", "53fb63a4472dcb6b32e99260"}}
+    if w := d.Select(work, testWorkers(3, 1, 2)); w.ID != 1 {
+        t.Error("expected worker 1, got", w.ID)
+    }
+}
+
+func TestRoundRobinDispatcher(t *testing.T) {
+    d, _ := NewDispatcher(DISPATCH_ROUND_ROBIN)
+    workers := testWorkers(0, 0, 0)
+    work := &Work{params: []string{"Q", "53fb63a4472dcb6b32e99260"}}
+    for i := 0; i < 6; i++ {
+        if w := d.Select(work, workers); w.ID != i%3 {
+            t.Error("expected worker", i%3, "got", w.ID)
+        }
+    }
+}
+
+func TestHashDispatcher(t *testing.T) {
+    d, _ := NewDispatcher(DISPATCH_HASH)
+    workers := testWorkers(0, 0, 0, 0)
+    q := &Work{params: []string{"Q", "53fb63a4472dcb6b32e99260"}}
+    qta := &Work{params: []string{"QTA", "53fb63a4472dcb6b32e99260", "10", "0"}}
+    if d.Select(q, workers) != d.Select(qta, workers) {
+        t.Error("queries for the same object landed on different workers")
+    }
+}
+
+func TestUnknownDispatcher(t *testing.T) {
+    if _, err := NewDispatcher("random"); err == nil {
+        t.Error("expected an error for an unknown strategy")
+    }
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "github.com/inSituo/Denormalizer/model"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+// Name of the option which wraps the pages of the list commands in an
+// envelope with the total number of items, see 'envelope'.
+const OPTION_ENVELOPE = "envelope"
+
+// Wrap a page of a list in an envelope, if the request asked for it. 'total'
+// counts the items of the whole list.
+// The other parameters are the arguments of the list command and its result.
+func (w *Worker) envelope(
+    a oidCountPageArgs,
+    total func(id bson.ObjectId) (int, error),
+    items interface{},
+    exists bool,
+    err error,
+) (interface{}, bool, error) {
+    if err != nil || !exists || !a.envelope {
+        return items, exists, err
+    }
+    n, err := total(a.id)
+    if err != nil {
+        return nil, false, err
+    }
+    return &model.List{
+        Items:   items,
+        Total:   n,
+        Page:    a.page,
+        Count:   a.count,
+        HasMore: (a.page+1)*a.count < n,
+    }, true, nil
+}
+
+// The number of users who joined a question, counting only those who still
+// exist, like the pages of joins.
+func (w *Worker) CountQuestionJoins(id bson.ObjectId) (int, error) {
+    pipe := w.db.Pipe(w.db.Questions, append(w.questionJoinStages(id), bson.M{
+        "$count": "n",
+    }))
+    var res struct {
+        N int `bson:"n"`
+    }
+    if err := pipe.One(&res); err != nil && err != mgo.ErrNotFound {
+        return 0, err
+    }
+    return res.N, nil
+}
+
+// The number of comments on a question.
+func (w *Worker) CountQuestionComments(id bson.ObjectId) (int, error) {
+    return w.db.Comments.
+        Find(bson.M{"oid": id, "type": "question"}).
+        SetMaxTime(w.db.MaxTime()).
+        Count()
+}
+
+// The number of answers to a question.
+func (w *Worker) CountAnswers(qid bson.ObjectId) (int, error) {
+    return w.db.Answers.
+        Find(bson.M{"qid": qid}).
+        SetMaxTime(w.db.MaxTime()).
+        Count()
+}
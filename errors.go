@@ -0,0 +1,85 @@
+package main
+
+import (
+    "encoding/json"
+    "github.com/inSituo/Denormalizer/model"
+    "gopkg.in/mgo.v2"
+    "io"
+    "net"
+)
+
+// Sent back to the client when its request was not done by its deadline.
+var ErrTimeout = newError(model.ERR_TIMEOUT, "Request timed out")
+
+// Sent back to the client when its request cannot be queued.
+var ErrOverloaded = newError(model.ERR_OVERLOADED, "Server overloaded")
+
+func newError(code, message string) *model.Error {
+    return &model.Error{Code: code, Message: message}
+}
+
+func badArgs(message string) *model.Error {
+    return newError(model.ERR_BAD_ARGS, message)
+}
+
+// Classify an error: errors with a code are returned as is, database errors
+// become TIMEOUT or BACKEND_UNAVAILABLE and anything else INTERNAL.
+func asError(err error) *model.Error {
+    if e, ok := err.(*model.Error); ok {
+        return e
+    }
+    if IsTimeout(err) {
+        return newError(model.ERR_TIMEOUT, err.Error())
+    }
+    if IsUnavailable(err) {
+        return newError(model.ERR_BACKEND_UNAVAILABLE, err.Error())
+    }
+    return newError(model.ERR_INTERNAL, err.Error())
+}
+
+// The codes of the MongoDB server errors telling that it can't serve the
+// request right now: it's shutting down, or not (or no longer) the primary.
+var unavailableCodes = map[int]bool{
+    6:     true, // HostUnreachable
+    7:     true, // HostNotFound
+    91:    true, // ShutdownInProgress
+    189:   true, // PrimarySteppedDown
+    10107: true, // NotWritablePrimary
+    11600: true, // InterruptedAtShutdown
+    11602: true, // InterruptedDueToReplStateChange
+    13435: true, // NotPrimaryNoSecondaryOk
+    13436: true, // NotPrimaryOrSecondary
+}
+
+// The errors which mgo returns without a type when it has no connection to
+// the database: no server answered, or the socket was closed.
+var unavailableMessages = map[string]bool{
+    "no reachable servers": true,
+    "Closed explicitly":    true,
+}
+
+// Did the operation fail because the database can't be reached?
+func IsUnavailable(err error) bool {
+    switch e := err.(type) {
+    case net.Error:
+        return true
+    case *mgo.QueryError:
+        return unavailableCodes[e.Code]
+    case *mgo.LastError:
+        return unavailableCodes[e.Code]
+    }
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+        return true
+    }
+    return unavailableMessages[err.Error()]
+}
+
+// The JSON encoded payload of a failure reply.
+func errorPayload(err error) []byte {
+    payload, merr := json.Marshal(asError(err))
+    if merr != nil {
+        // can't happen with two strings, but never send an empty failure:
+        return []byte(`{"code":"INTERNAL","message":"unable to encode error"}`)
+    }
+    return payload
+}
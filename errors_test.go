@@ -0,0 +1,56 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "github.com/inSituo/Denormalizer/model"
+    "gopkg.in/mgo.v2"
+    "io"
+    "net"
+    "testing"
+)
+
+func TestErrorPayload(t *testing.T) {
+    cases := map[string]error{
+        model.ERR_BAD_ARGS:            badArgs("Incorrect number of arguments"),
+        model.ERR_TIMEOUT:             ErrTimeout,
+        model.ERR_BACKEND_UNAVAILABLE: io.EOF,
+        model.ERR_INTERNAL:            errors.New("something else"),
+    }
+    for code, err := range cases {
+        var e model.Error
+        if jerr := json.Unmarshal(errorPayload(err), &e); jerr != nil {
+            t.Fatal(jerr)
+        }
+        if e.Code != code {
+            t.Error("expected", code, "got", e.Code, "for", err)
+        }
+    }
+    if _, err := parseOid([]string{"Q"}); asError(err).Code != model.ERR_BAD_ARGS {
+        t.Error("parsers must return BAD_ARGS errors, got", err)
+    }
+}
+
+func TestIsUnavailable(t *testing.T) {
+    unavailable := []error{
+        io.EOF,
+        &net.OpError{Op: "dial", Err: errors.New("connection refused")},
+        &mgo.QueryError{Code: 91, Message: "shutdown in progress"},
+        &mgo.LastError{Code: 10107, Err: "not primary"},
+        errors.New("no reachable servers"),
+    }
+    for _, err := range unavailable {
+        if !IsUnavailable(err) {
+            t.Error("expected an unavailable error", err)
+        }
+    }
+    available := []error{
+        &mgo.QueryError{Code: 2, Message: "no reachable servers in the query"},
+        errors.New("failed: no reachable servers"),
+    }
+    for _, err := range available {
+        if IsUnavailable(err) {
+            t.Error("unexpected unavailable error", err)
+        }
+    }
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+    "fmt"
+    "github.com/inSituo/LeveledLogger"
+    zmq "github.com/pebbe/zmq4"
+    "os"
+    "syscall"
+    "time"
+)
+
+// The frontend is the only goroutine which touches the ROUTER socket.
+// Products are handed back to it over an inproc PUSH/PULL pipe, so it can
+// block on a poll of both sockets instead of sharing the ROUTER behind a
+// lock.
+type Frontend struct {
+    // The address the ROUTER socket is bound to.
+    addr string
+
+    log *LeveledLogger.Logger
+
+    context *zmq.Context
+
+    // The client facing socket. Owned by the goroutine running 'Run'.
+    router *zmq.Socket
+
+    // The PULL end of the replies pipe. Owned by the goroutine running 'Run'.
+    replies *zmq.Socket
+
+    // The PULL end of the control pipe, used to stop the frontend.
+    control *zmq.Socket
+
+    // Inproc endpoints of the replies and control pipes. They are unique per
+    // frontend so that several frontends can share a context.
+    repliesAddr string
+    controlAddr string
+
+    // A buffered channel into which the frontend pushes received requests.
+    // The frontend closes it when it is stopped.
+    incoming chan *Work
+
+    // A buffered channel from which the frontend takes products to send.
+    outgoing chan *Product
+}
+
+// Construct a new frontend and bind its sockets.
+// If 'curve' is not nil, the ROUTER socket is a CURVE server, and its ZAP
+// handler must already be bound in the context.
+// The frontend does not start receiving requests until 'Run' is called.
+func NewFrontend(
+    context *zmq.Context,
+    addr string,
+    incoming chan *Work,
+    outgoing chan *Product,
+    curve *Curve,
+    ll_level int,
+) (*Frontend, error) {
+    f := &Frontend{
+        addr:        addr,
+        log:         LeveledLogger.New(os.Stdout, ll_level),
+        context:     context,
+        repliesAddr: fmt.Sprintf("inproc://replies-%p", incoming),
+        controlAddr: fmt.Sprintf("inproc://control-%p", incoming),
+        incoming:    incoming,
+        outgoing:    outgoing,
+    }
+    var err error
+    if f.router, err = f.context.NewSocket(zmq.ROUTER); err != nil {
+        return nil, err
+    }
+    // the security options must be set before the socket is bound:
+    if curve != nil {
+        if err = curve.Apply(f.router); err != nil {
+            f.router.Close()
+            return nil, err
+        }
+    }
+    if err = f.router.Bind(addr); err != nil {
+        f.router.Close()
+        return nil, err
+    }
+    // inproc endpoints must be bound before anyone connects to them:
+    if f.replies, err = f.bind(zmq.PULL, f.repliesAddr); err != nil {
+        f.router.Close()
+        return nil, err
+    }
+    if f.control, err = f.bind(zmq.PULL, f.controlAddr); err != nil {
+        f.router.Close()
+        f.replies.Close()
+        return nil, err
+    }
+    return f, nil
+}
+
+// How long the replies which were not sent yet are kept when the frontend
+// is closed. Must be called before 'Run'.
+func (f *Frontend) SetLinger(linger time.Duration) error {
+    return f.router.SetLinger(linger)
+}
+
+func (f *Frontend) bind(t zmq.Type, addr string) (*zmq.Socket, error) {
+    soc, err := f.context.NewSocket(t)
+    if err != nil {
+        return nil, err
+    }
+    if err := soc.Bind(addr); err != nil {
+        soc.Close()
+        return nil, err
+    }
+    return soc, nil
+}
+
+// Stop the frontend. It stops receiving requests and closes the incoming
+// channel right away, but keeps sending replies until the outgoing channel is
+// closed and drained. Only then 'Run' returns.
+// Safe to call from any goroutine.
+func (f *Frontend) Stop() error {
+    soc, err := f.context.NewSocket(zmq.PUSH)
+    if err != nil {
+        return err
+    }
+    defer soc.Close()
+    if err := soc.Connect(f.controlAddr); err != nil {
+        return err
+    }
+    _, err = soc.SendMessage("STOP")
+    return err
+}
+
+// Take products from the outgoing channel and push them into the replies
+// pipe. Runs in its own goroutine, which owns the PUSH socket, until the
+// outgoing channel is closed. Then a single part end marker is pushed, which
+// tells the frontend that every reply was relayed.
+func (f *Frontend) forward() {
+    iname := "Frontend.forward"
+    push, err := f.context.NewSocket(zmq.PUSH)
+    if err != nil {
+        f.log.Error(iname, "failed to create replies socket", err) // this will panic
+    }
+    defer push.Close()
+    if err := push.Connect(f.repliesAddr); err != nil {
+        f.log.Error(iname, "failed to connect replies socket", err) // this will panic
+    }
+    for prod := range f.outgoing {
+        msg := []interface{}{prod.id}
+        if prod.parts == nil {
+            msg = append(msg, prod.success, prod.empty, prod.payload)
+        } else {
+            for _, p := range prod.parts {
+                msg = append(msg, p.success, p.empty, p.payload)
+            }
+        }
+        if _, err := push.SendMessage(msg...); err != nil {
+            f.log.Warn(iname, "unable to forward reply", err)
+        }
+    }
+    if _, err := push.SendMessage(""); err != nil {
+        f.log.Warn(iname, "unable to send end marker", err)
+    }
+}
+
+// Run the frontend: receive requests from the ROUTER socket and send the
+// products coming back from the workers, until 'Stop' is called and every
+// product was sent.
+func (f *Frontend) Run() error {
+    iname := "Frontend.Run"
+    defer f.router.Close()
+    defer f.replies.Close()
+    defer f.control.Close()
+
+    go f.forward()
+
+    poller := zmq.NewPoller()
+    poller.Add(f.router, zmq.POLLIN)
+    poller.Add(f.replies, zmq.POLLIN)
+    poller.Add(f.control, zmq.POLLIN)
+
+    f.log.Info(iname, "listening to incoming requests", f.addr)
+    stopping := false
+    for {
+        // block until one of the sockets is readable:
+        polled, err := poller.Poll(-1)
+        if err != nil {
+            if zmq.AsErrno(err) == zmq.Errno(syscall.EINTR) {
+                continue
+            }
+            return err
+        }
+        for _, p := range polled {
+            switch p.Socket {
+            case f.router:
+                if !stopping {
+                    f.receive()
+                }
+            case f.replies:
+                if !f.reply() {
+                    f.log.Debug(iname, "stopped")
+                    return nil
+                }
+            case f.control:
+                f.control.RecvMessage(0)
+                if !stopping {
+                    f.log.Info(iname, "stopped receiving requests")
+                    stopping = true
+                    poller.RemoveBySocket(f.router)
+                    close(f.incoming)
+                }
+            }
+        }
+    }
+}
+
+// Receive one request from the ROUTER socket and queue it for dispatching.
+// If the incoming queue is full, the request is rejected right away rather
+// than blocking the replies.
+func (f *Frontend) receive() {
+    iname := "Frontend.receive"
+    msg, err := f.router.RecvMessage(0)
+    if err != nil {
+        f.log.Warn(iname, "failed to receive incoming message", err)
+        return
+    }
+    if len(msg) < 2 {
+        f.log.Debug(iname, "not enough message parts", len(msg))
+        return
+    }
+    work := &Work{
+        id:     msg[:2],
+        params: msg[2:],
+    }
+    select {
+    case f.incoming <- work:
+    default:
+        f.log.Warn(iname, "incoming queue is full, rejecting request")
+        f.send(work.id, false, false, errorPayload(ErrOverloaded))
+    }
+}
+
+// Relay one product from the replies pipe to the ROUTER socket.
+// Returns false when the end marker is received instead.
+func (f *Frontend) reply() bool {
+    iname := "Frontend.reply"
+    msg, err := f.replies.RecvMessage(0)
+    if err != nil {
+        f.log.Warn(iname, "failed to receive reply", err)
+        return true
+    }
+    if len(msg) == 1 {
+        return false
+    }
+    f.log.Debug(iname, "sending reply", msg)
+    if _, err := f.router.SendMessage(msg); err != nil {
+        f.log.Warn(iname, "unable to send reply", err)
+    }
+    return true
+}
+
+func (f *Frontend) send(parts ...interface{}) {
+    if _, err := f.router.SendMessage(parts...); err != nil {
+        f.log.Warn("Frontend.send", "unable to send reply", err)
+    }
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "github.com/inSituo/Denormalizer/model"
+    "github.com/inSituo/LeveledLogger"
+    "net/http"
+    "os"
+    "strconv"
+    "time"
+)
+
+const (
+    // Page size of the list routes when the 'count' parameter is missing.
+    HTTP_DEFAULT_COUNT = 10
+)
+
+// HTTP status codes of failure replies, by error code.
+var httpStatus = map[string]int{
+    model.ERR_BAD_ARGS:            http.StatusBadRequest,
+    model.ERR_UNKNOWN_COMMAND:     http.StatusNotFound,
+    model.ERR_NOT_FOUND:           http.StatusNotFound,
+    model.ERR_TIMEOUT:             http.StatusGatewayTimeout,
+    model.ERR_BACKEND_UNAVAILABLE: http.StatusServiceUnavailable,
+    model.ERR_OVERLOADED:          http.StatusServiceUnavailable,
+    model.ERR_INTERNAL:            http.StatusInternalServerError,
+}
+
+// The gateway is an HTTP/JSON frontend. Each route is translated into a
+// command, which goes through the same dispatcher and workers as the
+// requests received by the ROUTER socket.
+//
+// Query parameters other than 'count' and 'page' are passed as request
+// options, for example '?timeout=250&nocache'.
+type Gateway struct {
+    log *LeveledLogger.Logger
+
+    // The queue shared with the ROUTER frontend. The gateway must be shut
+    // down before the frontend closes it.
+    incoming chan *Work
+
+    server *http.Server
+}
+
+// Construct a new gateway listening on the given TCP port.
+func NewGateway(port int, incoming chan *Work, ll_level int) *Gateway {
+    g := &Gateway{
+        log:      LeveledLogger.New(os.Stdout, ll_level),
+        incoming: incoming,
+    }
+    mux := http.NewServeMux()
+    mux.HandleFunc("GET /questions/{id}", g.route("Q", false))
+    mux.HandleFunc("GET /questions/{id}/joins", g.route("QJ", true))
+    mux.HandleFunc("GET /questions/{id}/comments", g.route("QLC", true))
+    mux.HandleFunc("GET /questions/{id}/answers/top", g.route("QTA", true))
+    mux.HandleFunc("GET /questions/{id}/answers/latest", g.route("QLA", true))
+    mux.HandleFunc("GET /answers/{id}", g.route("A", false))
+    g.server = &http.Server{
+        Addr:    fmt.Sprintf(":%d", port),
+        Handler: mux,
+    }
+    return g
+}
+
+// Serve HTTP requests until 'Shutdown' is called.
+func (g *Gateway) Run() error {
+    g.log.Info("Gateway.Run", "listening to HTTP requests", g.server.Addr)
+    if err := g.server.ListenAndServe(); err != http.ErrServerClosed {
+        return err
+    }
+    return nil
+}
+
+// Stop accepting HTTP requests and wait for the ones in progress, for up to
+// 'timeout'.
+func (g *Gateway) Shutdown(timeout time.Duration) error {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    return g.server.Shutdown(ctx)
+}
+
+// Build the handler of a route which runs the command 'cmd' with the 'id'
+// path parameter. List commands also get the 'count' and 'page' query
+// parameters.
+func (g *Gateway) route(cmd string, list bool) http.HandlerFunc {
+    return func(rw http.ResponseWriter, r *http.Request) {
+        params := []string{cmd, r.PathValue("id")}
+        query := r.URL.Query()
+        if list {
+            count := query.Get("count")
+            if count == "" {
+                count = strconv.Itoa(HTTP_DEFAULT_COUNT)
+            }
+            page := query.Get("page")
+            if page == "" {
+                page = "0"
+            }
+            params = append(params, count, page)
+            query.Del("count")
+            query.Del("page")
+        }
+        for name := range query {
+            opt := OPTION_PREFIX + name
+            if value := query.Get(name); value != "" {
+                opt += "=" + value
+            }
+            params = append(params, opt)
+        }
+        g.serve(rw, r, params)
+    }
+}
+
+// Queue the request and write its product as the HTTP response.
+func (g *Gateway) serve(rw http.ResponseWriter, r *http.Request, params []string) {
+    iname := "Gateway.serve"
+    work := &Work{
+        params: params,
+        replyc: make(chan *Product, 1),
+    }
+    select {
+    case g.incoming <- work:
+    default:
+        g.log.Warn(iname, "incoming queue is full, rejecting request")
+        g.write(rw, &Product{success: false, payload: errorPayload(ErrOverloaded)})
+        return
+    }
+    select {
+    case prod := <-work.replyc:
+        g.write(rw, prod)
+    case <-r.Context().Done():
+        // the client went away. the worker won't block on the buffered
+        // reply channel.
+        g.log.Debug(iname, "client went away", params)
+    }
+}
+
+// Write a product as an HTTP response:
+//   - success: 200 and the JSON payload
+//   - empty: 404 and a NOT_FOUND error
+//   - failure: the status code matching the error code, and the error
+func (g *Gateway) write(rw http.ResponseWriter, prod *Product) {
+    rw.Header().Set("Content-Type", "application/json")
+    switch {
+    case prod.success && !prod.empty:
+        rw.WriteHeader(http.StatusOK)
+        rw.Write(prod.payload)
+    case prod.success:
+        rw.WriteHeader(http.StatusNotFound)
+        rw.Write(errorPayload(newError(model.ERR_NOT_FOUND, "Object does not exist")))
+    default:
+        var e model.Error
+        status := http.StatusInternalServerError
+        if err := json.Unmarshal(prod.payload, &e); err == nil {
+            if s, found := httpStatus[e.Code]; found {
+                status = s
+            }
+        }
+        rw.WriteHeader(status)
+        rw.Write(prod.payload)
+    }
+}
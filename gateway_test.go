@@ -0,0 +1,59 @@
+package main
+
+import (
+    "github.com/inSituo/LeveledLogger"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+)
+
+func TestGateway(t *testing.T) {
+    incoming := make(chan *Work, 1)
+    g := NewGateway(0, incoming, LeveledLogger.LL_INFO)
+
+    // stands in for the dispatcher and the workers:
+    replies := map[string]*Product{
+        "Q":   {success: true, empty: false, payload: []byte(`{"id":"53fb63a4472dcb6b32e99260"}`)},
+        "A":   {success: true, empty: true},
+        "QTA": {success: false, payload: errorPayload(ErrTimeout)},
+    }
+    var received []string
+    go func() {
+        for work := range incoming {
+            received = work.params
+            work.reply(replies[work.params[0]], nil)
+        }
+    }()
+    defer close(incoming)
+
+    cases := []struct {
+        url    string
+        status int
+        params []string
+    }{
+        {"/questions/53fb63a4472dcb6b32e99260", http.StatusOK, []string{"Q", "53fb63a4472dcb6b32e99260"}},
+        {"/answers/53fb63a4472dcb6b32e99260", http.StatusNotFound, []string{"A", "53fb63a4472dcb6b32e99260"}},
+        {
+            "/questions/53fb63a4472dcb6b32e99260/answers/top?count=5&timeout=100",
+            http.StatusGatewayTimeout,
+            []string{"QTA", "53fb63a4472dcb6b32e99260", "5", "0", "@timeout=100"},
+        },
+    }
+    for _, c := range cases {
+        rec := httptest.NewRecorder()
+        g.server.Handler.ServeHTTP(rec, httptest.NewRequest("GET", c.url, nil))
+        if rec.Code != c.status {
+            t.Error(c.url, "expected status", c.status, "got", rec.Code)
+        }
+        if !reflect.DeepEqual(received, c.params) {
+            t.Error(c.url, "expected params", c.params, "got", received)
+        }
+    }
+    // the metrics are only served by STATS:
+    rec := httptest.NewRecorder()
+    g.server.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+    if rec.Code != http.StatusNotFound {
+        t.Error("expected the metrics not to be served, got", rec.Code)
+    }
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+    "github.com/inSituo/Denormalizer/model"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+    "reflect"
+)
+
+const (
+    // The kind of index needed by the geo queries.
+    GEO_INDEX = "2dsphere"
+)
+
+// Sent back to QN requests when the questions have no geo index, or none of
+// them has the geo field, see 'CheckGeo'.
+var ErrGeoUnavailable = newError(model.ERR_BACKEND_UNAVAILABLE, "Questions have no geo index or locations")
+
+func init() {
+    RegisterCommand(&Command{
+        Name: "QN",
+        Desc: "Questions near a location, nearest first, with their distance in meters",
+        Args: []CommandArg{
+            {"LAT", ARG_FLOAT},
+            {"LON", ARG_FLOAT},
+            {"RADIUS", ARG_FLOAT},
+            {"COUNT", ARG_INT},
+            {"PAGE", ARG_INT},
+        },
+        Options: viewerOptions,
+        Parse:   parseGeoCountPageArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(geoCountPageArgs)
+            return w.GetNearQuestions(a.lat, a.lon, a.radius, a.count, a.page, a.viewer)
+        },
+        Tags: questionListTags,
+    })
+}
+
+// getNearQuestions generates the denormalized data of the questions near a
+// location, sorted by distance. It needs a 2dsphere index on the geo field of
+// the questions (the '-geofield' flag), which holds the location of their last
+// revision, see 'UpdateGeo'. The distances are those computed by '$geoNear'.
+// Params:
+//  1. lat, lon - The location
+//  2. radius - The maximum distance of the questions, in meters
+//  3. count - how many questions to return
+//  4. page - page offset of the questions (starting from 0)
+//  5. viewer - The viewer of the request, or nil
+//
+// Return:
+//  1. Pointer to an array of NearQuestion structs
+//  2. (bool) Always true, no questions is an empty array
+//  3. (error) Nil or an error
+func (w *Worker) GetNearQuestions(lat, lon, radius float64, count, page int, viewer *Viewer) (*[]model.NearQuestion, bool, error) {
+    if !w.settings.geoReady {
+        return nil, false, ErrGeoUnavailable
+    }
+    // questions at the same distance are sorted by ID, so pages don't overlap:
+    order := bson.D{{Name: "distance", Value: 1}, {Name: "_id", Value: 1}}
+    stages := []bson.M{
+        {
+            "$geoNear": bson.M{
+                "near": bson.M{
+                    "type":        "Point",
+                    "coordinates": []float64{lon, lat},
+                },
+                "key":           w.settings.geoField,
+                "distanceField": "distance",
+                "maxDistance":   radius,
+                "spherical":     true,
+            },
+        },
+        {
+            "$sort": order,
+        },
+        {
+            "$skip": count * page,
+        },
+        {
+            "$limit": count,
+        },
+    }
+    // the rest of the stages are the same as a single question's, but
+    // grouping the revisions loses the order of the questions:
+    stages = append(stages, questionPipeline(bson.M{}, viewer, "distance")[1:]...)
+    stages = append(stages, bson.M{"$sort": order})
+    pipe := w.db.Pipe(w.db.Questions, stages)
+    qs := make([]model.NearQuestion, 0)
+    if err := pipe.All(&qs); err != nil && err != mgo.ErrNotFound {
+        return nil, false, err
+    }
+    return &qs, true, nil
+}
+
+// The GeoJSON point of the location of the last revision, the latest one.
+// Returns false if there are no revisions.
+func geoPoint(revs []model.QuestionRevision) (bson.M, bool) {
+    if len(revs) == 0 {
+        return nil, false
+    }
+    last := revs[0]
+    for _, rev := range revs[1:] {
+        if rev.TS >= last.TS {
+            last = rev
+        }
+    }
+    // GeoJSON has the longitude first:
+    return bson.M{
+        "type":        "Point",
+        "coordinates": []interface{}{float64(last.Loc.Crd.Lon), float64(last.Loc.Crd.Lat)},
+    }, true
+}
+
+// The fields of a question needed to set its geo field.
+type geoQuestion struct {
+    ID     bson.ObjectId            `bson:"_id"`
+    Revs   []model.QuestionRevision `bson:"revs"`
+    Fields bson.M                   `bson:",inline"`
+}
+
+// The projection of a 'geoQuestion'.
+func geoSelect(field string) bson.M {
+    return bson.M{
+        "revs.ts":      true,
+        "revs.loc.crd": true,
+        field:          true,
+    }
+}
+
+// Set the geo field of a question to the GeoJSON point of its last revision's
+// location (see 'geoPoint'), unless it's up to date.
+// Return:
+//  1. (bool) Was the question updated?
+//  2. (error) Nil or an error
+func setGeo(db *DB, field string, q *geoQuestion) (bool, error) {
+    point, ok := geoPoint(q.Revs)
+    if !ok || reflect.DeepEqual(q.Fields[field], point) {
+        return false, nil
+    }
+    if err := db.Questions.UpdateId(q.ID, bson.M{"$set": bson.M{field: point}}); err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// UpdateGeo sets the geo field of a question, which QN needs, to the location
+// of its last revision. The watcher calls it for every written question.
+// Params:
+//  1. db - The database
+//  2. field - The geo field of the questions (the '-geofield' flag)
+//  3. id - The question ID
+//
+// Return:
+//  1. (bool) Was the question updated? False if it doesn't exist
+//  2. (error) Nil or an error
+func UpdateGeo(db *DB, field string, id bson.ObjectId) (bool, error) {
+    var q geoQuestion
+    if err := db.Questions.FindId(id).Select(geoSelect(field)).One(&q); err != nil {
+        if err == mgo.ErrNotFound {
+            return false, nil
+        }
+        return false, err
+    }
+    return setGeo(db, field, &q)
+}
+
+// BackfillGeo sets the geo field of all the questions, see 'UpdateGeo'.
+// Questions whose field is up to date are not written, so it can be run again
+// to catch up with the revisions added while the server wasn't watching.
+// Params:
+//  1. db - The database
+//  2. field - The geo field of the questions (the '-geofield' flag)
+//
+// Return:
+//  1. (int) The number of updated questions
+//  2. (error) Nil or an error
+func BackfillGeo(db *DB, field string) (int, error) {
+    iter := db.Questions.Find(nil).Select(geoSelect(field)).Iter()
+    n := 0
+    for {
+        // a new struct each time, the inline map would keep the fields of
+        // the previous question:
+        var q geoQuestion
+        if !iter.Next(&q) {
+            break
+        }
+        updated, err := setGeo(db, field, &q)
+        if err != nil {
+            iter.Close()
+            return n, err
+        }
+        if updated {
+            n++
+        }
+    }
+    return n, iter.Close()
+}
+
+// CheckGeo tells if QN can be answered: the geo field of the questions must
+// have a 2dsphere index, and some questions must have the field, unless there
+// are no questions yet.
+func CheckGeo(db *DB, field string) (bool, error) {
+    indexed, err := HasIndex(db.Questions, GEO_INDEX, field)
+    if err != nil || !indexed {
+        return false, err
+    }
+    n, err := db.Questions.Find(bson.M{field: bson.M{"$exists": true}}).Limit(1).Count()
+    if err != nil || n > 0 {
+        return n > 0, err
+    }
+    n, err = db.Questions.Find(nil).Limit(1).Count()
+    return n == 0, err
+}
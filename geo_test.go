@@ -0,0 +1,51 @@
+package main
+
+import (
+    "github.com/inSituo/Denormalizer/model"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+    "testing"
+)
+
+func TestGeoIndex(t *testing.T) {
+    indexes := []mgo.Index{
+        {Key: []string{"_id"}},
+        {Key: []string{"$2dsphere:geo"}},
+    }
+    if !hasIndexKey(indexes, GEO_INDEX, "geo") {
+        t.Error("2dsphere index not found")
+    }
+    if hasIndexKey(indexes, GEO_INDEX, "loc") || hasIndexKey(indexes[:1], GEO_INDEX, "geo") {
+        t.Error("unexpected 2dsphere index")
+    }
+}
+
+func TestQuestionPipelineKeep(t *testing.T) {
+    stages := questionPipeline(bson.M{}, nil, "distance")
+    id := stages[3]["$group"].(bson.M)["_id"].(bson.M)
+    project := stages[4]["$project"].(bson.M)
+    if id["distance"] != "$distance" || project["distance"] != "$_id.distance" {
+        t.Error("distance not kept", id, project)
+    }
+}
+
+func TestGeoPoint(t *testing.T) {
+    if _, ok := geoPoint(nil); ok {
+        t.Error("expected no point without revisions")
+    }
+    point, ok := geoPoint([]model.QuestionRevision{
+        {TS: 2, Loc: model.Location{Crd: model.Coordinates{Lat: 32.5, Lon: 34.75}}},
+        {TS: 1, Loc: model.Location{Crd: model.Coordinates{Lat: 10, Lon: 20}}},
+    })
+    coordinates := point["coordinates"].([]interface{})
+    if !ok || point["type"] != "Point" || coordinates[0] != 34.75 || coordinates[1] != 32.5 {
+        t.Error("unexpected point", point)
+    }
+}
+
+func TestGeoUnavailable(t *testing.T) {
+    w := &Worker{settings: &Settings{geoField: "geo"}}
+    if _, _, err := w.GetNearQuestions(32, 34, 500, 10, 0, nil); err != ErrGeoUnavailable {
+        t.Error("expected QN to be unavailable", err)
+    }
+}
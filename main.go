@@ -7,23 +7,58 @@ import (
     "fmt"
     "github.com/inSituo/LeveledLogger"
     "os"
+    "os/signal"
+    "syscall"
+    "time"
 )
 
 type DenormConf struct {
-    mongo   MongoConf
-    port    *int
-    workers *int
-    wbuff   *int
-    debug   *bool
+    mongo        MongoConf
+    port         *int
+    workers      *int
+    wbuff        *int
+    dispatch     *string
+    grace        *time.Duration
+    timeout      *time.Duration
+    cachesize    *int
+    cachettl     *string
+    watch        *bool
+    resume       *string
+    http         *int
+    maxids       *int
+    secretfile   *string
+    viewerfile   *string
+    anonname     *string
+    geofield     *string
+    userfields   *string
+    curvekey     *string
+    curveclients *string
+    debug        *bool
 }
 
 func main() {
     iname := "main"
     conf := DenormConf{
-        debug:   flag.Bool("debug", false, "Enable debug log messages"),
-        port:    flag.Int("port", 7710, "ZeroMQ listening port"),
-        workers: flag.Int("workers", 5, "Number of workers"),
-        wbuff:   flag.Int("buffer", 100, "Size of one worker's buffer"),
+        debug:        flag.Bool("debug", false, "Enable debug log messages"),
+        port:         flag.Int("port", 7710, "ZeroMQ listening port"),
+        workers:      flag.Int("workers", 5, "Number of workers"),
+        wbuff:        flag.Int("buffer", 100, "Size of one worker's buffer"),
+        dispatch:     flag.String("dispatch", DISPATCH_LEAST_LOADED, "Worker selection strategy: least-loaded, round-robin or hash"),
+        grace:        flag.Duration("grace", 10*time.Second, "How long to wait for pending requests on shutdown"),
+        timeout:      flag.Duration("timeout", 5*time.Second, "Default time limit of a request"),
+        cachesize:    flag.Int("cachesize", 10000, "Maximum number of cached results, 0 disables the cache"),
+        cachettl:     flag.String("cachettl", "Q=10s,QJ=10s,QLC=5s,QP=5s,A=10s,QTA=5s,QLA=5s,U=10s", "Time to live of cached results per command, commands which are not listed are not cached"),
+        watch:        flag.Bool("watch", false, "Evict cached results when their data changes, by tailing the oplog (requires a replica set)"),
+        resume:       flag.String("resumefile", "", "File in which the oplog watcher saves its resume token"),
+        http:         flag.Int("http", 0, "HTTP gateway listening port, 0 disables the gateway"),
+        maxids:       flag.Int("maxids", 100, "Maximum number of IDs in one QM or AM request"),
+        secretfile:   flag.String("secretfile", "", "File with the key signing the list cursors, a random key is used if empty (cursors are then invalid after a restart)"),
+        viewerfile:   flag.String("viewersecretfile", "", "File with the key signing the viewer options, viewer options are rejected if empty"),
+        anonname:     flag.String("anonname", "Anonymous", "Name shown instead of the authors of anonymous answers"),
+        geofield:     flag.String("geofield", "geo", "Field of the questions with the GeoJSON point of their location, which needs a 2dsphere index"),
+        userfields:   flag.String("userfields", "", "Comma separated fields of the users returned by U, in addition to their name"),
+        curvekey:     flag.String("curvekey", "", "File with the server's CURVE secret key, enables CURVE encryption and authentication"),
+        curveclients: flag.String("curveclients", "", "File with the public keys of the allowed CURVE clients, one per line, reloaded on SIGHUP"),
         mongo: MongoConf{
             Port:       flag.Int("mport", 27017, "MongoDB server port"),
             Host:       flag.String("mhost", "127.0.0.1", "MongoDB server host"),
@@ -36,6 +71,8 @@ func main() {
     }
 
     showHelp := flag.Bool("help", false, "Show help")
+    keygen := flag.String("keygen", "", "Generate a CURVE keypair into <name>.key and <name>.pub, and exit")
+    geobackfill := flag.Bool("geobackfill", false, "Set the -geofield of the questions to the location of their last revision, and exit")
 
     flag.Parse()
     if *showHelp {
@@ -50,6 +87,23 @@ func main() {
         flag.PrintDefaults()
         return
     }
+    if *keygen != "" {
+        if err := GenerateKeypair(*keygen); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        fmt.Printf("keypair written to %s.key and %s.pub\n", *keygen, *keygen)
+        return
+    }
+    if *geobackfill {
+        n, err := backfillGeo(&conf)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        fmt.Printf("updated the location of %d questions\n", n)
+        return
+    }
 
     ll_level := LeveledLogger.LL_INFO
     if *conf.debug {
@@ -59,8 +113,40 @@ func main() {
 
     log.Debug(iname, "debug mode enabled")
 
-    server := NewServer(*conf.port, *conf.workers, *conf.wbuff, &conf.mongo, ll_level)
-    err := server.Run()
-    log.Error(iname, "server run error", err) // this will panic
+    server := NewServer(&conf, ll_level)
+
+    // shut down gracefully on SIGTERM / SIGINT:
+    sigc := make(chan os.Signal, 1)
+    signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+    go func() {
+        sig := <-sigc
+        log.Info(iname, "received signal", sig)
+        server.Shutdown()
+    }()
 
+    // reload the allowed CURVE clients on SIGHUP:
+    hupc := make(chan os.Signal, 1)
+    signal.Notify(hupc, syscall.SIGHUP)
+    go func() {
+        for range hupc {
+            log.Info(iname, "received SIGHUP, reloading allowed clients")
+            server.Reload()
+        }
+    }()
+
+    if err := server.Run(); err != nil {
+        log.Warn(iname, "server run error", err)
+        os.Exit(1)
+    }
+    log.Info(iname, "server stopped")
+}
+
+// Run 'BackfillGeo' on the configured database.
+func backfillGeo(conf *DenormConf) (int, error) {
+    db, err := NewDB(&conf.mongo)
+    if err != nil {
+        return 0, err
+    }
+    defer db.Close()
+    return BackfillGeo(db, *conf.geofield)
 }
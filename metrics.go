@@ -0,0 +1,37 @@
+package main
+
+import (
+    "expvar"
+)
+
+// Runtime metrics of the server. They are published through the 'expvar'
+// package and can be queried by clients with the 'STATS' command.
+var (
+    stats = expvar.NewMap("denormalizer")
+
+    // Number of items in each worker's buffer, keyed by worker ID.
+    queueDepth = new(expvar.Map).Init()
+
+    // Number of requests which were not done by their deadline.
+    timeouts = new(expvar.Int)
+
+    // Number of cache lookups which found, or didn't find, a fresh entry.
+    cacheHits   = new(expvar.Int)
+    cacheMisses = new(expvar.Int)
+
+    // Number of cache entries evicted because their data changed.
+    cacheInvalidations = new(expvar.Int)
+
+    // Number of requests which were answered with the product of an
+    // identical request in flight, instead of being executed.
+    coalesced = new(expvar.Int)
+)
+
+func init() {
+    stats.Set("queue_depth", queueDepth)
+    stats.Set("timeouts", timeouts)
+    stats.Set("cache_hits", cacheHits)
+    stats.Set("cache_misses", cacheMisses)
+    stats.Set("cache_invalidations", cacheInvalidations)
+    stats.Set("coalesced", coalesced)
+}
@@ -0,0 +1,36 @@
+package model
+
+// Error codes of failure replies.
+const (
+    // The request arguments or options are invalid.
+    ERR_BAD_ARGS = "BAD_ARGS"
+
+    // No command with the requested name exists.
+    ERR_UNKNOWN_COMMAND = "UNKNOWN_COMMAND"
+
+    // An object the result refers to (such as the author of a comment) does
+    // not exist. A missing requested object is an empty reply, not an error.
+    ERR_NOT_FOUND = "NOT_FOUND"
+
+    // The request was not done by its deadline.
+    ERR_TIMEOUT = "TIMEOUT"
+
+    // The database can't be reached.
+    ERR_BACKEND_UNAVAILABLE = "BACKEND_UNAVAILABLE"
+
+    // The server is too busy to accept the request.
+    ERR_OVERLOADED = "OVERLOADED"
+
+    // Any other error.
+    ERR_INTERNAL = "INTERNAL"
+)
+
+// The payload of a failure reply.
+type Error struct {
+    Code    string `json:"code"`
+    Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+    return e.Code + ": " + e.Message
+}
@@ -0,0 +1,191 @@
+// Package model holds the denormalized objects returned by the Denormalizer.
+// They are shared by the server, which produces them, and the client package,
+// which decodes them.
+package model
+
+import (
+    "gopkg.in/mgo.v2/bson"
+)
+
+type Coordinates struct {
+    Lat float32 `bson:"lat" json:"lat"`
+    Lon float32 `bson:"lon" json:"lon"`
+}
+
+type Location struct {
+    Crd  Coordinates `bson:"crd" json:"crd"`
+    Path []string    `bson:"path" json:"path"`
+}
+
+type Question struct {
+    ID      bson.ObjectId `bson:"_id" json:"id"`
+    TS      int           `bson:"ts" json:"ts"`
+    Loc     Location      `bson:"loc" json:"loc"`
+    Title   string        `bson:"title" json:"title"`
+    Content string        `bson:"content" json:"content"`
+    Joins   int           `bson:"joins" json:"joins"`
+
+    // Set if the request has a viewer: has the viewer joined the question?
+    ViewerJoined *bool `bson:"viewerJoined,omitempty" json:"viewerJoined,omitempty"`
+}
+
+type QuestionJoin struct {
+    Uid   bson.ObjectId `bson:"uid" json:"uid"`
+    Udisp string        `bson:"udisp" json:"udisp"`
+}
+
+type Comment struct {
+    ID      bson.ObjectId `bson:"_id" json:"id"`
+    Uid     bson.ObjectId `bson:"uid" json:"uid"`
+    Udisp   string        `bson:"udisp" json:"udisp"`
+    TS      int           `bson:"ts" json:"ts"`
+    Content string        `bson:"content" json:"content"`
+}
+
+type Answer struct {
+    ID         bson.ObjectId `bson:"_id" json:"id"`
+    LTS        int           `bson:"lts" json:"lts"`
+    FTS        int           `bson:"fts" json:"fts"`
+    Qid        bson.ObjectId `bson:"qid" json:"qid"`
+    Fuid       bson.ObjectId `bson:"fuid" json:"fuid"`
+    Luid       bson.ObjectId `bson:"luid" json:"luid"`
+    Fudisp     string        `bson:"fudisp" json:"fudisp"`
+    Ludisp     string        `bson:"ludisp" json:"ludisp"`
+    Anon       bool          `bson:"anon" json:"anon"`
+    Locs       []Location    `bson:"locs" json:"locs"`
+    Content    string        `bson:"content" json:"content"`
+    Ranking    int           `bson:"ranking" json:"ranking"`
+    Thanks     int           `bson:"thanks" json:"thanks"`
+    Thumbups   int           `bson:"thumbups" json:"thumbups"`
+    Thumbdowns int           `bson:"thumbdowns" json:"thumbdowns"`
+
+    // Set if the request has a viewer: has the viewer thanked, thumbed up or
+    // thumbed down the answer?
+    ViewerThanked     *bool `bson:"viewerThanked,omitempty" json:"viewerThanked,omitempty"`
+    ViewerThumbedUp   *bool `bson:"viewerThumbedUp,omitempty" json:"viewerThumbedUp,omitempty"`
+    ViewerThumbedDown *bool `bson:"viewerThumbedDown,omitempty" json:"viewerThumbedDown,omitempty"`
+}
+
+// A question found near a location, and its distance from the location in
+// meters.
+type NearQuestion struct {
+    Question `bson:",inline"`
+    Distance float64 `bson:"distance" json:"distance"`
+}
+
+// A question found by a text search, its relevance score and a snippet of its
+// content with the matching words highlighted.
+type SearchResult struct {
+    Question `bson:",inline"`
+    Score    float64 `bson:"score" json:"score"`
+    Snippet  string  `bson:"-" json:"snippet"`
+}
+
+// A child segment of a location path, and the number of questions under it.
+type PathSegment struct {
+    Segment   string `bson:"_id" json:"segment"`
+    Questions int    `bson:"questions" json:"questions"`
+}
+
+// A user's profile. 'Fields' holds the extra fields of the user set by the
+// '-userfields' flag. The counts leave out anonymous answers, unless the
+// request's viewer is the user or a moderator. 'Questions' is missing if the
+// questions' revisions don't tell their editor.
+type UserProfile struct {
+    ID        bson.ObjectId          `json:"id"`
+    Name      string                 `json:"name"`
+    Fields    map[string]interface{} `json:"fields"`
+    Questions *int                   `json:"questions,omitempty"`
+    Answers   int                    `json:"answers"`
+    Thumbups  int                    `json:"thumbups"`
+    Thanks    int                    `json:"thanks"`
+    Joins     int                    `json:"joins"`
+}
+
+// A revision of a question. 'Index' is the position of the revision in the
+// question's revisions, which identifies it in diffs.
+type QuestionRevision struct {
+    Index   int      `bson:"index" json:"index"`
+    TS      int      `bson:"ts" json:"ts"`
+    Loc     Location `bson:"loc" json:"loc"`
+    Title   string   `bson:"title" json:"title"`
+    Content string   `bson:"content" json:"content"`
+}
+
+// A revision of an answer, and the name of the user who wrote it.
+type AnswerRevision struct {
+    Index   int           `bson:"index" json:"index"`
+    TS      int           `bson:"ts" json:"ts"`
+    Uid     bson.ObjectId `bson:"uid" json:"uid"`
+    Udisp   string        `bson:"-" json:"udisp"`
+    Locs    []Location    `bson:"locs" json:"locs"`
+    Content string        `bson:"content" json:"content"`
+}
+
+// A user who wrote revisions of an answer, and how many.
+type Contributor struct {
+    Uid   bson.ObjectId `bson:"_id" json:"uid"`
+    Udisp string        `bson:"-" json:"udisp"`
+    Edits int           `bson:"edits" json:"edits"`
+}
+
+// A page of the revisions of an answer, and all the users who wrote them,
+// the most edits first.
+type AnswerHistory struct {
+    Revisions    []AnswerRevision `json:"revisions"`
+    Contributors []Contributor    `json:"contributors"`
+}
+
+// Operations of the lines of a diff.
+const (
+    DIFF_EQUAL  = "="
+    DIFF_INSERT = "+"
+    DIFF_DELETE = "-"
+)
+
+// A line of a diff: 'Op' tells if the line is in both texts, only in the new
+// one or only in the old one.
+type DiffLine struct {
+    Op   string `json:"op"`
+    Text string `json:"text"`
+}
+
+// The line-level differences between two revisions.
+type Diff struct {
+    From    int        `json:"from"`
+    To      int        `json:"to"`
+    Title   []DiffLine `json:"title"`
+    Content []DiffLine `json:"content"`
+}
+
+// A page of the revisions of a question, with the diff requested with the
+// '@diff' option, if any.
+type QuestionHistory struct {
+    Revisions []QuestionRevision `json:"revisions"`
+    Diff      *Diff              `json:"diff,omitempty"`
+}
+
+// All the data needed to display a question page.
+type QuestionPage struct {
+    Question *Question      `json:"question"`
+    Answers  []Answer       `json:"answers"`
+    Comments []Comment      `json:"comments"`
+    Joins    []QuestionJoin `json:"joins"`
+}
+
+// A page of a list requested with the '@envelope' option, with the total
+// number of items in the list.
+type List struct {
+    Items   interface{} `json:"items"`
+    Total   int         `json:"total"`
+    Page    int         `json:"page"`
+    Count   int         `json:"count"`
+    HasMore bool        `json:"hasMore"`
+}
+
+// A page of a list requested with a cursor instead of a page number. 'Next'
+// is the cursor of the next page, empty after the last page.
+type Page struct {
+    Items interface{} `json:"items"`
+    Next  string      `json:"next,omitempty"`
+}
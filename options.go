@@ -0,0 +1,43 @@
+package main
+
+import (
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Request options are sent as extra parts after the command arguments, in
+// the form '@name=value', or '@name' for flags. They are removed from the
+// parameters before the command is parsed, so commands don't need to know
+// about them.
+const OPTION_PREFIX = "@"
+
+// Split the trailing option parts off the request parameters.
+func splitOptions(params []string) ([]string, map[string]string) {
+    opts := make(map[string]string)
+    n := len(params)
+    for n > 1 && strings.HasPrefix(params[n-1], OPTION_PREFIX) {
+        opt := strings.TrimPrefix(params[n-1], OPTION_PREFIX)
+        name, value := opt, ""
+        if i := strings.Index(opt, "="); i >= 0 {
+            name, value = opt[:i], opt[i+1:]
+        }
+        opts[name] = value
+        n--
+    }
+    return params[:n], opts
+}
+
+// The time a request may take, set by the '@timeout=<milliseconds>' option.
+// Returns 'def' if the option is not set.
+func timeoutOption(opts map[string]string, def time.Duration) (time.Duration, error) {
+    v, found := opts["timeout"]
+    if !found {
+        return def, nil
+    }
+    ms, err := strconv.Atoi(v)
+    if err != nil || ms <= 0 {
+        return 0, badArgs("Timeout option is not a positive integer")
+    }
+    return time.Duration(ms) * time.Millisecond, nil
+}
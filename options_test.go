@@ -0,0 +1,34 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestSplitOptions(t *testing.T) {
+    params, opts := splitOptions([]string{"QTA", "53fb63a4472dcb6b32e99260", "10", "0", "@timeout=250", "@nocache"})
+    if !reflect.DeepEqual(params, []string{"QTA", "53fb63a4472dcb6b32e99260", "10", "0"}) {
+        t.Error("unexpected params", params)
+    }
+    if !reflect.DeepEqual(opts, map[string]string{"timeout": "250", "nocache": ""}) {
+        t.Error("unexpected options", opts)
+    }
+    // the command itself is never taken as an option:
+    params, opts = splitOptions([]string{"@timeout=1"})
+    if len(params) != 1 || len(opts) != 0 {
+        t.Error("command was taken as an option", params, opts)
+    }
+}
+
+func TestTimeoutOption(t *testing.T) {
+    if d, err := timeoutOption(map[string]string{}, time.Second); err != nil || d != time.Second {
+        t.Error("expected the default timeout, got", d, err)
+    }
+    if d, err := timeoutOption(map[string]string{"timeout": "250"}, time.Second); err != nil || d != 250*time.Millisecond {
+        t.Error("expected 250ms, got", d, err)
+    }
+    if _, err := timeoutOption(map[string]string{"timeout": "-1"}, time.Second); err == nil {
+        t.Error("expected an error for a negative timeout")
+    }
+}
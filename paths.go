@@ -0,0 +1,188 @@
+package main
+
+import (
+    "github.com/inSituo/Denormalizer/model"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+    "strconv"
+)
+
+// The sorts accepted by 'QL', and the fields of the questions they sort by.
+var pathSorts = map[string]string{
+    "ts":    "ts",
+    "joins": "joins",
+}
+
+func init() {
+    RegisterCommand(&Command{
+        Name: "QL",
+        Desc: "Questions under a location path, sorted by ts or joins",
+        Args: []CommandArg{
+            {"PATH", ARG_STRING},
+            {"COUNT", ARG_INT},
+            {"PAGE", ARG_INT},
+            {"SORT", ARG_STRING},
+        },
+        Options: viewerOptions,
+        Parse:   parsePathCountPageArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(pathCountPageArgs)
+            return w.GetPathQuestions(a.path, a.count, a.page, a.sort, a.viewer)
+        },
+        Tags: questionListTags,
+    })
+    RegisterCommand(&Command{
+        Name:  "QLP",
+        Desc:  "Child segments of a location path, with their number of questions",
+        Args:  []CommandArg{{"PATH", ARG_STRING}},
+        Parse: parsePathArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            return w.GetPathSegments(args.([]string))
+        },
+        Tags: questionListTags,
+    })
+}
+
+// The conditions matching the questions whose location path starts with
+// 'path'. 'prefix' is prepended to the fields.
+func pathMatch(prefix string, path []string) bson.M {
+    match := bson.M{}
+    for i, seg := range path {
+        match[prefix+"path."+strconv.Itoa(i)] = seg
+    }
+    return match
+}
+
+// The aggregation stage which adds the last revision of each question in
+// 'last_rev': the latest one, the same as the '$last' of 'questionPipeline'.
+var lastRevisionStage = bson.M{
+    "$addFields": bson.M{
+        "last_rev": bson.M{
+            "$reduce": bson.M{
+                "input":        "$revs",
+                "initialValue": bson.M{"$arrayElemAt": []interface{}{"$revs", 0}},
+                "in": bson.M{
+                    "$cond": []interface{}{
+                        bson.M{"$gte": []interface{}{"$$this.ts", "$$value.ts"}},
+                        "$$this",
+                        "$$value",
+                    },
+                },
+            },
+        },
+    },
+}
+
+// The conditions selecting the questions which may be under 'path': those
+// with a revision under the path, since only they can have their last
+// revision under it. They can use an index on 'revs.loc.path'.
+func pathFilter(path []string) bson.M {
+    if len(path) == 0 {
+        // every question with a revision is under the empty path:
+        return bson.M{"revs.0": bson.M{"$exists": true}}
+    }
+    return bson.M{
+        "revs.loc.path": bson.M{"$all": path},
+        "revs":          bson.M{"$elemMatch": pathMatch("loc.", path)},
+    }
+}
+
+// The aggregation stages which select the questions whose last revision is
+// under 'path'. They handle every question on its own (no '$unwind', '$sort'
+// or '$group' of the collection), and the first one can use an index on
+// 'revs.loc.path'. Except for the empty path, they add the last revision of
+// the questions, see 'lastRevisionStage'.
+func pathPipeline(path []string) []bson.M {
+    if len(path) == 0 {
+        return []bson.M{
+            {
+                "$match": pathFilter(path),
+            },
+        }
+    }
+    return []bson.M{
+        {
+            "$match": pathFilter(path),
+        },
+        lastRevisionStage,
+        {
+            "$match": pathMatch("last_rev.loc.", path),
+        },
+    }
+}
+
+// getPathQuestions generates the denormalized data of the questions whose
+// location path, in their last revision, starts with 'path'.
+// Params:
+//  1. path - The segments of the location path
+//  2. count - how many questions to return
+//  3. page - page offset of the questions (starting from 0)
+//  4. sort - The field to sort by, descending
+//  5. viewer - The viewer of the request, or nil
+//
+// Return:
+//  1. Pointer to an array of Question structs
+//  2. (bool) Always true, no questions is an empty array
+//  3. (error) Nil or an error
+func (w *Worker) GetPathQuestions(path []string, count, page int, sort string, viewer *Viewer) (*[]model.Question, bool, error) {
+    order := bson.D{{Name: sort, Value: -1}, {Name: "_id", Value: -1}}
+    // the page is selected before the questions are denormalized, so only
+    // its questions are grouped; the sort is limited to the page's size:
+    stages := append(pathPipeline(path), []bson.M{
+        {
+            "$sort": order,
+        },
+        {
+            "$skip": count * page,
+        },
+        {
+            "$limit": count,
+        },
+    }...)
+    stages = append(stages, questionPipeline(bson.M{}, viewer)[1:]...)
+    // grouping the revisions loses the order of the questions:
+    stages = append(stages, bson.M{"$sort": order})
+    pipe := w.db.Pipe(w.db.Questions, stages).AllowDiskUse()
+    qs := make([]model.Question, 0)
+    if err := pipe.All(&qs); err != nil && err != mgo.ErrNotFound {
+        return nil, false, err
+    }
+    return &qs, true, nil
+}
+
+// getPathSegments counts the questions under each child segment of a
+// location path, to drill down the paths.
+// Params: path - The segments of the location path
+// Return:
+//  1. Pointer to an array of PathSegment structs, the segments with the most
+//     questions first
+//  2. (bool) Always true, a path without children has an empty array
+//  3. (error) Nil or an error
+func (w *Worker) GetPathSegments(path []string) (*[]model.PathSegment, bool, error) {
+    stages := pathPipeline(path)
+    if len(path) == 0 {
+        stages = append(stages, lastRevisionStage)
+    }
+    child := "last_rev.loc.path." + strconv.Itoa(len(path))
+    pipe := w.db.Pipe(w.db.Questions, append(stages, []bson.M{
+        {
+            "$match": bson.M{
+                child: bson.M{"$exists": true},
+            },
+        },
+        {
+            "$group": bson.M{
+                "_id":       bson.M{"$arrayElemAt": []interface{}{"$last_rev.loc.path", len(path)}},
+                "questions": bson.M{"$sum": 1},
+            },
+        },
+        {
+            "$sort": bson.D{{Name: "questions", Value: -1}, {Name: "_id", Value: 1}},
+        },
+    }...)).AllowDiskUse()
+    segs := make([]model.PathSegment, 0)
+    if err := pipe.All(&segs); err != nil && err != mgo.ErrNotFound {
+        return nil, false, err
+    }
+    return &segs, true, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+    "gopkg.in/mgo.v2/bson"
+    "testing"
+)
+
+func TestPathPipeline(t *testing.T) {
+    // the empty path only needs questions with revisions:
+    if stages := pathPipeline(nil); len(stages) != 1 {
+        t.Error("unexpected stages", stages)
+    }
+    stages := pathPipeline([]string{"il", "tel-aviv"})
+    if len(stages) != 3 {
+        t.Fatal("unexpected stages", stages)
+    }
+    // the first stage selects the questions with the index:
+    all := stages[0]["$match"].(bson.M)["revs.loc.path"].(bson.M)["$all"].([]string)
+    if len(all) != 2 || all[1] != "tel-aviv" {
+        t.Error("unexpected index match", stages[0])
+    }
+    // and the last one checks their last revision:
+    last := stages[2]["$match"].(bson.M)
+    if last["last_rev.loc.path.0"] != "il" || last["last_rev.loc.path.1"] != "tel-aviv" {
+        t.Error("unexpected last revision match", last)
+    }
+}
@@ -1,39 +1,387 @@
 package main
 
 import (
-    "errors"
+    "fmt"
     "gopkg.in/mgo.v2/bson"
     "strconv"
+    "strings"
 )
 
 // params parsers:
 
+// The arguments structs also carry the viewer of the request, nil if it has
+// none, see 'parseViewer'.
+
+// Arguments of commands which expect an object ID.
+type oidArgs struct {
+    id     bson.ObjectId
+    viewer *Viewer
+}
+
+// Arguments of commands which expect an object ID, a count and a page.
+// The page may be a cursor instead, then 'cursor' is set and 'page' is 0.
+// 'envelope' is set by the '@envelope' option.
+type oidCountPageArgs struct {
+    id       bson.ObjectId
+    count    int
+    page     int
+    cursor   *Cursor
+    envelope bool
+    viewer   *Viewer
+}
+
+// Arguments of commands which expect one or more object IDs.
+type oidsArgs struct {
+    ids    []bson.ObjectId
+    viewer *Viewer
+}
+
+// Arguments of the question page command.
+type questionPageArgs struct {
+    id       bson.ObjectId
+    answers  int
+    comments int
+    joins    int
+    viewer   *Viewer
+}
+
+// Arguments of commands which expect a location, a radius in meters, a
+// count and a page.
+type geoCountPageArgs struct {
+    lat    float64
+    lon    float64
+    radius float64
+    count  int
+    page   int
+    viewer *Viewer
+}
+
+// Arguments of commands which expect a location path, a count, a page and
+// the field to sort by.
+type pathCountPageArgs struct {
+    path   []string
+    count  int
+    page   int
+    sort   string
+    viewer *Viewer
+}
+
+// Arguments of the search command. 'path' is set by the '@path' option.
+type searchArgs struct {
+    terms  string
+    count  int
+    page   int
+    path   []string
+    viewer *Viewer
+}
+
+// Arguments of the revision history commands. 'diff' is set by the '@diff'
+// option, with the indices of the two revisions to compare.
+type revisionsArgs struct {
+    id     bson.ObjectId
+    count  int
+    page   int
+    diff   []int
+    viewer *Viewer
+}
+
+func parseNoArgs(s *Settings, params []string, opts map[string]string) (interface{}, error) {
+    if len(params) != 1 {
+        return nil, badArgs("Incorrect number of arguments")
+    }
+    return nil, nil
+}
+
+func parseOidArgs(s *Settings, params []string, opts map[string]string) (interface{}, error) {
+    id, err := parseOid(params)
+    if err != nil {
+        return nil, err
+    }
+    viewer, err := s.parseViewer(opts)
+    if err != nil {
+        return nil, err
+    }
+    return oidArgs{id, viewer}, nil
+}
+
+func parseOidsArgs(s *Settings, params []string, opts map[string]string) (interface{}, error) {
+    if len(params) < 2 {
+        return nil, badArgs("Incorrect number of arguments")
+    }
+    if len(params)-1 > s.maxIds {
+        return nil, badArgs(fmt.Sprintf("Too many IDs (max %d)", s.maxIds))
+    }
+    ids := make([]bson.ObjectId, 0, len(params)-1)
+    for _, id := range params[1:] {
+        if !bson.IsObjectIdHex(id) {
+            return nil, badArgs(fmt.Sprintf("Parameter '%s' is an invalid BSON ObjectId", id))
+        }
+        ids = append(ids, bson.ObjectIdHex(id))
+    }
+    viewer, err := s.parseViewer(opts)
+    if err != nil {
+        return nil, err
+    }
+    return oidsArgs{ids, viewer}, nil
+}
+
+func parseOidCountPageArgs(s *Settings, params []string, opts map[string]string) (interface{}, error) {
+    viewer, err := s.parseViewer(opts)
+    if err != nil {
+        return nil, err
+    }
+    _, envelope := opts[OPTION_ENVELOPE]
+    if len(params) == 4 && isCursor(params[3]) {
+        if envelope {
+            // the pages of cursors already carry the cursor of the next page
+            return nil, badArgs("The envelope option requires a page number")
+        }
+        return parseOidCountCursorArgs(s, params, viewer)
+    }
+    id, count, page, err := parseOidCountPage(params)
+    if err != nil {
+        return nil, err
+    }
+    return oidCountPageArgs{
+        id:       id,
+        count:    count,
+        page:     page,
+        envelope: envelope,
+        viewer:   viewer,
+    }, nil
+}
+
+// Parse the arguments of a list command whose page is a cursor.
+func parseOidCountCursorArgs(s *Settings, params []string, viewer *Viewer) (interface{}, error) {
+    id, count, _, err := parseOidCountPage([]string{params[0], params[1], params[2], "0"})
+    if err != nil {
+        return nil, err
+    }
+    cursor, err := s.parseCursor(params[3], params[0], id)
+    if err != nil {
+        return nil, err
+    }
+    return oidCountPageArgs{
+        id:     id,
+        count:  count,
+        cursor: cursor,
+        viewer: viewer,
+    }, nil
+}
+
 func parseOid(params []string) (bson.ObjectId, error) {
     if len(params) != 2 {
-        return bson.NewObjectId(), errors.New("Incorrect number of arguments")
+        return bson.NewObjectId(), badArgs("Incorrect number of arguments")
     }
     id := params[1]
     if !bson.IsObjectIdHex(id) {
-        return bson.NewObjectId(), errors.New("Parameter is an invalid BSON ObjectId")
+        return bson.NewObjectId(), badArgs("Parameter is an invalid BSON ObjectId")
     }
     return bson.ObjectIdHex(id), nil
 }
 
 func parseOidCountPage(params []string) (bson.ObjectId, int, int, error) {
     if len(params) != 4 {
-        return bson.NewObjectId(), -1, -1, errors.New("Incorrect number of arguments")
+        return bson.NewObjectId(), -1, -1, badArgs("Incorrect number of arguments")
     }
     oid := params[1]
     if !bson.IsObjectIdHex(oid) {
-        return bson.NewObjectId(), -1, -1, errors.New("First argument is an invalid BSON ObjectId")
+        return bson.NewObjectId(), -1, -1, badArgs("First argument is an invalid BSON ObjectId")
     }
     count, err := strconv.Atoi(params[2])
     if err != nil {
-        return bson.NewObjectId(), -1, -1, errors.New("Second argument is not an integer")
+        return bson.NewObjectId(), -1, -1, badArgs("Second argument is not an integer")
+    }
+    if count <= 0 {
+        return bson.NewObjectId(), -1, -1, badArgs("Second argument is not a positive integer")
     }
     page, err := strconv.Atoi(params[3])
     if err != nil {
-        return bson.NewObjectId(), -1, -1, errors.New("Third argument is not an integer")
+        return bson.NewObjectId(), -1, -1, badArgs("Third argument is not an integer")
+    }
+    if page < 0 {
+        return bson.NewObjectId(), -1, -1, badArgs("Third argument is not a non-negative integer")
     }
     return bson.ObjectIdHex(oid), count, page, nil
 }
+
+func parseQuestionPageArgs(s *Settings, params []string, opts map[string]string) (interface{}, error) {
+    if len(params) != 5 {
+        return nil, badArgs("Incorrect number of arguments")
+    }
+    if !bson.IsObjectIdHex(params[1]) {
+        return nil, badArgs("First argument is an invalid BSON ObjectId")
+    }
+    counts := make([]int, 3)
+    for i, name := range []string{"Second", "Third", "Fourth"} {
+        n, err := strconv.Atoi(params[i+2])
+        if err != nil || n < 0 {
+            return nil, badArgs(name + " argument is not a non-negative integer")
+        }
+        counts[i] = n
+    }
+    viewer, err := s.parseViewer(opts)
+    if err != nil {
+        return nil, err
+    }
+    return questionPageArgs{bson.ObjectIdHex(params[1]), counts[0], counts[1], counts[2], viewer}, nil
+}
+
+func parseGeoCountPageArgs(s *Settings, params []string, opts map[string]string) (interface{}, error) {
+    if len(params) != 6 {
+        return nil, badArgs("Incorrect number of arguments")
+    }
+    lat, err := strconv.ParseFloat(params[1], 64)
+    if err != nil || lat < -90 || lat > 90 {
+        return nil, badArgs("First argument is not a latitude")
+    }
+    lon, err := strconv.ParseFloat(params[2], 64)
+    if err != nil || lon < -180 || lon > 180 {
+        return nil, badArgs("Second argument is not a longitude")
+    }
+    radius, err := strconv.ParseFloat(params[3], 64)
+    if err != nil || radius <= 0 {
+        return nil, badArgs("Third argument is not a positive number")
+    }
+    count, err := strconv.Atoi(params[4])
+    if err != nil || count <= 0 {
+        return nil, badArgs("Fourth argument is not a positive integer")
+    }
+    page, err := strconv.Atoi(params[5])
+    if err != nil || page < 0 {
+        return nil, badArgs("Fifth argument is not a non-negative integer")
+    }
+    viewer, err := s.parseViewer(opts)
+    if err != nil {
+        return nil, err
+    }
+    return geoCountPageArgs{
+        lat:    lat,
+        lon:    lon,
+        radius: radius,
+        count:  count,
+        page:   page,
+        viewer: viewer,
+    }, nil
+}
+
+func parsePathCountPageArgs(s *Settings, params []string, opts map[string]string) (interface{}, error) {
+    if len(params) != 5 {
+        return nil, badArgs("Incorrect number of arguments")
+    }
+    path, err := parsePath(params[1])
+    if err != nil {
+        return nil, err
+    }
+    count, err := strconv.Atoi(params[2])
+    if err != nil || count <= 0 {
+        return nil, badArgs("Second argument is not a positive integer")
+    }
+    page, err := strconv.Atoi(params[3])
+    if err != nil || page < 0 {
+        return nil, badArgs("Third argument is not a non-negative integer")
+    }
+    if _, found := pathSorts[params[4]]; !found {
+        return nil, badArgs(fmt.Sprintf("Unknown sort '%s'", params[4]))
+    }
+    viewer, err := s.parseViewer(opts)
+    if err != nil {
+        return nil, err
+    }
+    return pathCountPageArgs{
+        path:   path,
+        count:  count,
+        page:   page,
+        sort:   pathSorts[params[4]],
+        viewer: viewer,
+    }, nil
+}
+
+func parsePathArgs(s *Settings, params []string, opts map[string]string) (interface{}, error) {
+    if len(params) != 2 {
+        return nil, badArgs("Incorrect number of arguments")
+    }
+    return parsePath(params[1])
+}
+
+// Parse a location path, with its segments separated by slashes. Leading and
+// trailing slashes are ignored, so "" and "/" are the empty path.
+func parsePath(s string) ([]string, error) {
+    s = strings.Trim(s, "/")
+    if s == "" {
+        return []string{}, nil
+    }
+    path := strings.Split(s, "/")
+    for _, seg := range path {
+        if seg == "" {
+            return nil, badArgs("Empty segment in the path")
+        }
+    }
+    return path, nil
+}
+
+func parseSearchArgs(s *Settings, params []string, opts map[string]string) (interface{}, error) {
+    if len(params) != 4 {
+        return nil, badArgs("Incorrect number of arguments")
+    }
+    if len(parseSearch(params[1]).words()) == 0 {
+        return nil, badArgs("No search terms")
+    }
+    count, err := strconv.Atoi(params[2])
+    if err != nil || count <= 0 {
+        return nil, badArgs("Second argument is not a positive integer")
+    }
+    page, err := strconv.Atoi(params[3])
+    if err != nil || page < 0 {
+        return nil, badArgs("Third argument is not a non-negative integer")
+    }
+    path, err := parsePath(opts[OPTION_PATH])
+    if err != nil {
+        return nil, err
+    }
+    viewer, err := s.parseViewer(opts)
+    if err != nil {
+        return nil, err
+    }
+    return searchArgs{
+        terms:  params[1],
+        count:  count,
+        page:   page,
+        path:   path,
+        viewer: viewer,
+    }, nil
+}
+
+func parseRevisionsArgs(s *Settings, params []string, opts map[string]string) (interface{}, error) {
+    id, count, page, err := parseOidCountPage(params)
+    if err != nil {
+        return nil, err
+    }
+    viewer, err := s.parseViewer(opts)
+    if err != nil {
+        return nil, err
+    }
+    a := revisionsArgs{id: id, count: count, page: page, viewer: viewer}
+    if v, found := opts[OPTION_DIFF]; found {
+        parts := strings.Split(v, ",")
+        if len(parts) != 2 {
+            return nil, badArgs("Diff option is not two revision indices")
+        }
+        for _, p := range parts {
+            i, err := strconv.Atoi(p)
+            if err != nil || i < 0 {
+                return nil, badArgs("Diff option is not two revision indices")
+            }
+            a.diff = append(a.diff, i)
+        }
+    }
+    return a, nil
+}
+
+// Parse the arguments of AR: those of QR, without the '@diff' option.
+func parseAnswerRevisionsArgs(s *Settings, params []string, opts map[string]string) (interface{}, error) {
+    if _, found := opts[OPTION_DIFF]; found {
+        return nil, badArgs("Diff option is only accepted by QR")
+    }
+    return parseRevisionsArgs(s, params, opts)
+}
@@ -1,27 +1,164 @@
 package main
 
 import (
-    "errors"
+    "github.com/inSituo/Denormalizer/model"
     "gopkg.in/mgo.v2"
     "gopkg.in/mgo.v2/bson"
 )
 
+func init() {
+    RegisterCommand(&Command{
+        Name:    "Q",
+        Desc:    "Question",
+        Args:    []CommandArg{{"ID", ARG_OID}},
+        Options: viewerOptions,
+        Parse:   parseOidArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(oidArgs)
+            return w.GetQuestion(a.id, a.viewer)
+        },
+    })
+    RegisterCommand(&Command{
+        Name:    "QM",
+        Desc:    "Many questions, in the requested order, null if missing",
+        Args:    []CommandArg{{"ID...", ARG_OID}},
+        Options: viewerOptions,
+        Parse:   parseOidsArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(oidsArgs)
+            return w.GetQuestions(a.ids, a.viewer)
+        },
+    })
+    RegisterCommand(&Command{
+        Name:    "QJ",
+        Desc:    "Question joins",
+        Args:    []CommandArg{{"ID", ARG_OID}, {"COUNT", ARG_INT}, {"PAGE", ARG_INT}},
+        Options: []string{OPTION_ENVELOPE},
+        Parse:   parseOidCountPageArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(oidCountPageArgs)
+            if a.cursor != nil {
+                return w.GetQuestionJoinsPage(a.id, a.count, a.cursor)
+            }
+            items, exists, err := w.GetQuestionJoins(a.id, a.count, a.page)
+            return w.envelope(a, w.CountQuestionJoins, items, exists, err)
+        },
+    })
+    RegisterCommand(&Command{
+        Name:    "QLC",
+        Desc:    "Question latest comments",
+        Args:    []CommandArg{{"ID", ARG_OID}, {"COUNT", ARG_INT}, {"PAGE", ARG_INT}},
+        Options: []string{OPTION_ENVELOPE},
+        Parse:   parseOidCountPageArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(oidCountPageArgs)
+            if a.cursor != nil {
+                return w.GetQuestionLatestCommentsPage(a.id, a.count, a.cursor)
+            }
+            items, exists, err := w.GetQuestionLatestComments(a.id, a.count, a.page)
+            return w.envelope(a, w.CountQuestionComments, items, exists, err)
+        },
+    })
+    RegisterCommand(&Command{
+        Name: "QP",
+        Desc: "Question page: the question, its top answers, latest comments and joins",
+        Args: []CommandArg{
+            {"ID", ARG_OID},
+            {"ANSWERS", ARG_INT},
+            {"COMMENTS", ARG_INT},
+            {"JOINS", ARG_INT},
+        },
+        Options: viewerOptions,
+        Parse:   parseQuestionPageArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(questionPageArgs)
+            return w.GetQuestionPage(a.id, a.answers, a.comments, a.joins, a.viewer)
+        },
+    })
+}
+
 // getQuestion generates a denormalized question data. It queries the database
 // for the data needed to display the question.
 // On success, it returns a pointer to a 'Question' struct.
-// Params: id - The requested question ID
+// Params:
+//  1. id - The requested question ID
+//  2. viewer - The viewer of the request, or nil
+//
 // Return:
 //  1. Pointer to a Question struct
 //  2. (bool) Does the requested question exist?
 //  3. (error) Nil or an error
-func (w *Worker) GetQuestion(id bson.ObjectId) (*Question, bool, error) {
+func (w *Worker) GetQuestion(id bson.ObjectId, viewer *Viewer) (*model.Question, bool, error) {
     // we use aggregation to bring question to its denormalized form.
+    pipe := w.db.Pipe(w.db.Questions, questionPipeline(bson.M{"_id": id}, viewer))
+    var q model.Question
+    if err := pipe.One(&q); err != nil {
+        if err != mgo.ErrNotFound {
+            return nil, false, err
+        }
+        // aggregation returned empty
+        return nil, false, nil
+    }
+    return &q, true, nil
+}
+
+// getQuestions generates the denormalized data of many questions with a
+// single query.
+// Params:
+//  1. ids - The requested question IDs
+//  2. viewer - The viewer of the request, or nil
+//
+// Return:
+//  1. Pointers to Question structs, in the order of 'ids'. The pointers of
+//     questions which don't exist are nil.
+//  2. (bool) Always true, missing questions are nil entries
+//  3. (error) Nil or an error
+func (w *Worker) GetQuestions(ids []bson.ObjectId, viewer *Viewer) ([]*model.Question, bool, error) {
+    pipe := w.db.Pipe(w.db.Questions, questionPipeline(bson.M{"_id": bson.M{"$in": ids}}, viewer))
+    var qs []model.Question
+    if err := pipe.All(&qs); err != nil && err != mgo.ErrNotFound {
+        return nil, false, err
+    }
+    found := make(map[bson.ObjectId]*model.Question, len(qs))
+    for i := range qs {
+        found[qs[i].ID] = &qs[i]
+    }
+    res := make([]*model.Question, len(ids))
+    for i, id := range ids {
+        res[i] = found[id]
+    }
+    return res, true, nil
+}
+
+// The aggregation pipeline which brings the questions matching 'match' to
+// their denormalized form, with the flags of the viewer if it's not nil.
+// The fields in 'keep' are copied as they are, such as the distance added by
+// '$geoNear'.
+func questionPipeline(match bson.M, viewer *Viewer, keep ...string) []bson.M {
+    id := bson.M{
+        "_id":   "$_id",
+        "ts":    "$ts",
+        "joins": "$joins",
+    }
+    project := bson.M{
+        "_id":     "$_id._id",
+        "ts":      "$_id.ts",
+        "joins":   "$_id.joins",
+        "loc":     "$last_rev.loc",
+        "title":   "$last_rev.title",
+        "content": "$last_rev.content",
+    }
+    for _, field := range keep {
+        id[field] = "$" + field
+        project[field] = "$_id." + field
+    }
+    viewer.addFlags(id, project, map[string]string{
+        "viewerJoined": "$juids",
+    })
     // we only need the last revision of the question's content.
-    pipe := w.db.Questions.Pipe([]bson.M{
+    return []bson.M{
         {
-            "$match": bson.M{
-                "_id": id,
-            },
+            "$match": match,
         },
         {
             "$unwind": "$revs",
@@ -33,36 +170,16 @@ func (w *Worker) GetQuestion(id bson.ObjectId) (*Question, bool, error) {
         },
         {
             "$group": bson.M{
-                "_id": bson.M{
-                    "_id":   "$_id",
-                    "ts":    "$ts",
-                    "joins": "$joins",
-                },
+                "_id": id,
                 "last_rev": bson.M{
                     "$last": "$revs",
                 },
             },
         },
         {
-            "$project": bson.M{
-                "_id":     "$_id._id",
-                "ts":      "$_id.ts",
-                "joins":   "$_id.joins",
-                "loc":     "$last_rev.loc",
-                "title":   "$last_rev.title",
-                "content": "$last_rev.content",
-            },
+            "$project": project,
         },
-    })
-    var q Question
-    if err := pipe.One(&q); err != nil {
-        if err != mgo.ErrNotFound {
-            return nil, false, err
-        }
-        // aggregation returned empty
-        return nil, false, nil
     }
-    return &q, true, nil
 }
 
 // getQuestionJoins generates a denormalized question joins data.
@@ -73,22 +190,102 @@ func (w *Worker) GetQuestion(id bson.ObjectId) (*Question, bool, error) {
 //  1. id - The requested question ID
 //  2. count - how many joins to return
 //  3. page - page offset of joins array (starting from 0)
+//
 // Return:
 //  1. Pointer to a QuestionJoins struct
 //  2. (bool) Does the requested question exist?
 //  3. (error) Nil or an error
-func (w *Worker) GetQuestionJoins(id bson.ObjectId, count, page int) (*[]QuestionJoin, bool, error) {
-    pipe := w.db.Questions.Pipe([]bson.M{
+func (w *Worker) GetQuestionJoins(id bson.ObjectId, count, page int) (*[]model.QuestionJoin, bool, error) {
+    juids, _, exists, err := w.getQuestionJoinIds(id, count, count*page, nil)
+    if err != nil || !exists {
+        return nil, exists, err
+    }
+    names, err := w.getUserNames(juids)
+    if err != nil {
+        return nil, false, err
+    }
+    qjs := questionJoins(juids, names)
+    return &qjs, true, nil
+}
+
+// Same as 'GetQuestionJoins', but the page starts after the cursor. Joins are
+// listed in the order they were made, so the sort key of a join is its
+// position in the question's joins.
+// Return:
+//  1. Pointer to a Page struct, with the joins and the next page's cursor
+//  2. (bool) Always true, a question without joins has an empty page
+//  3. (error) Nil or an error
+func (w *Worker) GetQuestionJoinsPage(id bson.ObjectId, count int, cursor *Cursor) (*model.Page, bool, error) {
+    juids, last, _, err := w.getQuestionJoinIds(id, count, 0, cursor)
+    if err != nil {
+        return nil, false, err
+    }
+    names, err := w.getUserNames(juids)
+    if err != nil {
+        return nil, false, err
+    }
+    page := model.Page{Items: questionJoins(juids, names)}
+    if len(juids) == count {
+        next, err := w.settings.encodeCursor(&Cursor{Cmd: cursor.Cmd, ID: id, Key: last, Last: juids[len(juids)-1]})
+        if err != nil {
+            return nil, false, err
+        }
+        page.Next = next
+    }
+    return &page, true, nil
+}
+
+// The aggregation stages which unwind the joins of a question, in 'juids',
+// with their position in 'idx'. The joins of users which don't exist are
+// dropped, as they are left out of the lists (see 'questionJoins'), so the
+// pages and their total count the same joins.
+func (w *Worker) questionJoinStages(id bson.ObjectId) []bson.M {
+    return []bson.M{
         {
             "$match": bson.M{
                 "_id": id,
             },
         },
         {
-            "$unwind": "$juids",
+            "$unwind": bson.M{
+                "path":              "$juids",
+                "includeArrayIndex": "idx",
+            },
+        },
+        {
+            "$lookup": bson.M{
+                "from":         w.db.Users.Name,
+                "localField":   "juids",
+                "foreignField": "_id",
+                "as":           "user",
+            },
+        },
+        {
+            "$match": bson.M{
+                "user": bson.M{"$ne": []interface{}{}},
+            },
         },
+    }
+}
+
+// The IDs of a page of the users who joined a question, without their names,
+// and the position of the last of them in the question's joins. The page
+// starts after 'skip' joins, or after the cursor if it's not nil.
+func (w *Worker) getQuestionJoinIds(id bson.ObjectId, count, skip int, cursor *Cursor) ([]bson.ObjectId, int, bool, error) {
+    stages := w.questionJoinStages(id)
+    if cursor != nil && !cursor.start() {
+        // skip the joins before the cursor before looking up their users:
+        stages = append(stages[:2], append([]bson.M{
+            {
+                "$match": bson.M{
+                    "idx": bson.M{"$gt": cursor.Key},
+                },
+            },
+        }, stages[2:]...)...)
+    }
+    stages = append(stages, []bson.M{
         {
-            "$skip": count * page,
+            "$skip": skip,
         },
         {
             "$limit": count,
@@ -97,43 +294,31 @@ func (w *Worker) GetQuestionJoins(id bson.ObjectId, count, page int) (*[]Questio
             "$group": bson.M{
                 "_id":   bson.M{"_id": "$_id"},
                 "juids": bson.M{"$push": "$juids"},
+                "last":  bson.M{"$last": "$idx"},
             },
         },
         {
             "$project": bson.M{
                 "_id":   false,
                 "juids": "$juids",
+                "last":  "$last",
             },
         },
-    })
-    // the result is a one element map:
-    // { "juids": [id1, id2, id3, ...]}
-    var juids map[string][]bson.ObjectId
-    if err := pipe.One(&juids); err != nil {
+    }...)
+    pipe := w.db.Pipe(w.db.Questions, stages)
+    // the result is a single document:
+    // { "juids": [id1, id2, id3, ...], "last": <position of the last id> }
+    var res struct {
+        Juids []bson.ObjectId `bson:"juids"`
+        Last  int             `bson:"last"`
+    }
+    if err := pipe.One(&res); err != nil {
         if err != mgo.ErrNotFound {
-            return nil, false, err
+            return nil, 0, false, err
         }
-        return nil, false, nil
+        return nil, 0, false, nil
     }
-    qjs := make([]QuestionJoin, 0, count)
-    pipe = w.db.Users.Pipe([]bson.M{
-        {
-            "$match": bson.M{
-                "_id": bson.M{"$in": juids["juids"]},
-            },
-        },
-        {
-            "$project": bson.M{
-                "_id":   false,
-                "uid":   "$_id",
-                "udisp": "$name",
-            },
-        },
-    })
-    if err := pipe.All(&qjs); err != nil {
-        return nil, false, err
-    }
-    return &qjs, true, nil
+    return res.Juids, res.Last, true, nil
 }
 
 // getQuestionLatestComments generates a denormalized question comments data.
@@ -143,51 +328,134 @@ func (w *Worker) GetQuestionJoins(id bson.ObjectId, count, page int) (*[]Questio
 //  1. id - The requested question ID
 //  2. count - how many comments to return
 //  3. page - page offset of comments array (starting from 0)
+//
 // Return:
 //  1. Pointer to a Comments struct
 //  2. (bool) Does the requested question exist?
 //  3. (error) Nil or an error
-func (w *Worker) GetQuestionLatestComments(id bson.ObjectId, count, page int) (*[]Comment, bool, error) {
-    cmts := make([]Comment, 0)
+func (w *Worker) GetQuestionLatestComments(id bson.ObjectId, count, page int) (*[]model.Comment, bool, error) {
+    cmts, exists, err := w.getQuestionLatestComments(id, count, count*page, nil)
+    if err != nil || !exists {
+        return nil, exists, err
+    }
+    names, err := w.getUserNames(commentUids(cmts))
+    if err != nil {
+        return nil, false, err
+    }
+    setCommentNames(cmts, names)
+    return &cmts, true, nil
+}
+
+// Same as 'GetQuestionLatestComments', but the page starts after the cursor.
+// Return:
+//  1. Pointer to a Page struct, with the comments and the next page's cursor
+//  2. (bool) Always true, a question without comments has an empty page
+//  3. (error) Nil or an error
+func (w *Worker) GetQuestionLatestCommentsPage(id bson.ObjectId, count int, cursor *Cursor) (*model.Page, bool, error) {
+    cmts, _, err := w.getQuestionLatestComments(id, count, 0, cursor)
+    if err != nil {
+        return nil, false, err
+    }
+    names, err := w.getUserNames(commentUids(cmts))
+    if err != nil {
+        return nil, false, err
+    }
+    setCommentNames(cmts, names)
+    page := model.Page{Items: cmts}
+    if len(cmts) == count {
+        last := cmts[len(cmts)-1]
+        next, err := w.settings.encodeCursor(&Cursor{Cmd: cursor.Cmd, ID: id, Key: last.TS, Last: last.ID})
+        if err != nil {
+            return nil, false, err
+        }
+        page.Next = next
+    }
+    return &page, true, nil
+}
+
+// A page of the latest comments of a question, without their authors' names.
+// The page starts after 'skip' comments, or after the cursor if it's not nil.
+func (w *Worker) getQuestionLatestComments(id bson.ObjectId, count, skip int, cursor *Cursor) ([]model.Comment, bool, error) {
+    cmts := make([]model.Comment, 0)
+    filter := bson.M{"oid": id, "type": "question"}
+    if cursor != nil && !cursor.start() {
+        filter["$or"] = cursor.after("ts")
+    }
     query := w.db.Comments.
-        Find(bson.M{"oid": id, "type": "question"}).
-        Sort("-ts").
-        Skip(count * page).
+        Find(filter).
+        Sort("-ts", "-_id").
+        Skip(skip).
         Limit(count).
         Select(bson.M{
-        "_id":     true,
-        "uid":     true,
-        "ts":      true,
-        "content": true})
+            "_id":     true,
+            "uid":     true,
+            "ts":      true,
+            "content": true}).
+        SetMaxTime(w.db.MaxTime())
     if err := query.All(&cmts); err != nil {
         if err != mgo.ErrNotFound {
             return nil, false, err
         }
         return nil, false, nil
     }
-    uids := make([]bson.ObjectId, 0, len(cmts))
-    for _, v := range cmts {
-        uids = append(uids, v.Uid)
-    }
-    query = w.db.Users.
-        Find(bson.M{"_id": bson.M{"$in": uids}}).
-        Select(bson.M{"_id": true, "name": true})
-    users := make([]struct {
-        ID   bson.ObjectId `bson:"_id"`
-        Name string        `bson:"name"`
-    }, len(uids))
-    if err := query.All(&users); err != nil {
-        if err != mgo.ErrNotFound {
+    return cmts, true, nil
+}
+
+// getQuestionPage generates all the data needed to display a question page:
+// the question, its top answers, its latest comments and the users who joined
+// it. The names of all the users are looked up with a single query.
+// Params:
+//  1. id - The requested question ID
+//  2. answers - how many top answers to return
+//  3. comments - how many latest comments to return
+//  4. joins - how many joins to return
+//  5. viewer - The viewer of the request, or nil
+//
+// Return:
+//  1. Pointer to a QuestionPage struct
+//  2. (bool) Does the requested question exist?
+//  3. (error) Nil or an error
+func (w *Worker) GetQuestionPage(id bson.ObjectId, answers, comments, joins int, viewer *Viewer) (*model.QuestionPage, bool, error) {
+    q, exists, err := w.GetQuestion(id, viewer)
+    if err != nil || !exists {
+        return nil, exists, err
+    }
+    qp := model.QuestionPage{
+        Question: q,
+        Answers:  []model.Answer{},
+        Comments: []model.Comment{},
+        Joins:    []model.QuestionJoin{},
+    }
+    // a zero limit is not allowed by MongoDB, so empty parts are skipped:
+    if answers > 0 {
+        as, _, err := w.getTopAnswers(id, answers, 0, viewer)
+        if err != nil {
             return nil, false, err
         }
-        return nil, false, errors.New("Unable to find user")
+        qp.Answers = append(qp.Answers, as...)
     }
-    names := make(map[bson.ObjectId]string)
-    for _, v := range users {
-        names[v.ID] = v.Name
+    if comments > 0 {
+        cmts, _, err := w.getQuestionLatestComments(id, comments, 0, nil)
+        if err != nil {
+            return nil, false, err
+        }
+        qp.Comments = append(qp.Comments, cmts...)
     }
-    for i, _ := range cmts {
-        cmts[i].Udisp = names[cmts[i].Uid]
+    var juids []bson.ObjectId
+    if joins > 0 {
+        if juids, _, _, err = w.getQuestionJoinIds(id, joins, 0, nil); err != nil {
+            return nil, false, err
+        }
     }
-    return &cmts, true, nil
+    uids := append(answerUids(qp.Answers), commentUids(qp.Comments)...)
+    names, err := w.getUserNames(append(uids, juids...))
+    if err != nil {
+        return nil, false, err
+    }
+    if err := w.settings.setAnswerNames(qp.Answers, names, viewer); err != nil {
+        return nil, false, err
+    }
+    setCommentNames(qp.Comments, names)
+    qp.Joins = questionJoins(juids, names)
+    return &qp, true, nil
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+    "fmt"
+    "github.com/inSituo/Denormalizer/model"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+    "sort"
+)
+
+// Compares two revisions, in the form '@diff=<from>,<to>' with the indices of
+// the revisions.
+const OPTION_DIFF = "diff"
+
+func init() {
+    RegisterCommand(&Command{
+        Name:    "QR",
+        Desc:    "Question revisions, newest first",
+        Args:    []CommandArg{{"ID", ARG_OID}, {"COUNT", ARG_INT}, {"PAGE", ARG_INT}},
+        Options: []string{OPTION_DIFF},
+        Parse:   parseRevisionsArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(revisionsArgs)
+            revs, exists, err := w.GetQuestionRevisions(a.id, a.count, a.page)
+            if err != nil || !exists {
+                return nil, exists, err
+            }
+            history := &model.QuestionHistory{Revisions: *revs}
+            if a.diff != nil {
+                history.Diff, exists, err = w.DiffQuestionRevisions(a.id, a.diff[0], a.diff[1])
+                if err != nil || !exists {
+                    return nil, exists, err
+                }
+            }
+            return history, true, nil
+        },
+    })
+    RegisterCommand(&Command{
+        Name:    "AR",
+        Desc:    "Answer revisions, newest first, with their editors and all the contributors",
+        Args:    []CommandArg{{"ID", ARG_OID}, {"COUNT", ARG_INT}, {"PAGE", ARG_INT}},
+        Options: viewerOptions,
+        Parse:   parseAnswerRevisionsArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(revisionsArgs)
+            return w.GetAnswerRevisions(a.id, a.count, a.page, a.viewer)
+        },
+    })
+}
+
+// getQuestionRevisions lists the revisions of a question.
+// Params:
+//  1. id - The requested question ID
+//  2. count - how many revisions to return
+//  3. page - page offset of the revisions (starting from 0)
+//
+// Return:
+//  1. Pointer to an array of QuestionRevision structs, newest first
+//  2. (bool) Does the requested question exist?
+//  3. (error) Nil or an error
+func (w *Worker) GetQuestionRevisions(id bson.ObjectId, count, page int) (*[]model.QuestionRevision, bool, error) {
+    pipe := w.db.Pipe(w.db.Questions, []bson.M{
+        {
+            "$match": bson.M{
+                "_id": id,
+            },
+        },
+        {
+            "$unwind": bson.M{
+                "path":              "$revs",
+                "includeArrayIndex": "idx",
+            },
+        },
+        {
+            "$sort": bson.D{{Name: "revs.ts", Value: -1}, {Name: "idx", Value: -1}},
+        },
+        {
+            "$skip": count * page,
+        },
+        {
+            "$limit": count,
+        },
+        {
+            "$project": bson.M{
+                "_id":     false,
+                "index":   "$idx",
+                "ts":      "$revs.ts",
+                "loc":     "$revs.loc",
+                "title":   "$revs.title",
+                "content": "$revs.content",
+            },
+        },
+    })
+    revs := make([]model.QuestionRevision, 0)
+    if err := pipe.All(&revs); err != nil && err != mgo.ErrNotFound {
+        return nil, false, err
+    }
+    if len(revs) == 0 {
+        // past the last page, or no such question?
+        n, err := w.db.Questions.FindId(id).SetMaxTime(w.db.MaxTime()).Count()
+        if err != nil || n == 0 {
+            return nil, false, err
+        }
+    }
+    return &revs, true, nil
+}
+
+// diffQuestionRevisions compares the titles and contents of two revisions
+// of a question, line by line.
+// Params:
+//  1. id - The requested question ID
+//  2. from, to - The indices of the revisions
+//
+// Return:
+//  1. Pointer to a Diff struct
+//  2. (bool) Does the requested question exist?
+//  3. (error) Nil or an error, BAD_ARGS if a revision doesn't exist
+func (w *Worker) DiffQuestionRevisions(id bson.ObjectId, from, to int) (*model.Diff, bool, error) {
+    var q struct {
+        Revs []struct {
+            Title   string `bson:"title"`
+            Content string `bson:"content"`
+        } `bson:"revs"`
+    }
+    query := w.db.Questions.
+        FindId(id).
+        Select(bson.M{"revs.title": true, "revs.content": true}).
+        SetMaxTime(w.db.MaxTime())
+    if err := query.One(&q); err != nil {
+        if err != mgo.ErrNotFound {
+            return nil, false, err
+        }
+        return nil, false, nil
+    }
+    if from >= len(q.Revs) || to >= len(q.Revs) {
+        return nil, false, badArgs(fmt.Sprintf("The question has %d revisions", len(q.Revs)))
+    }
+    return &model.Diff{
+        From:    from,
+        To:      to,
+        Title:   lineDiff(q.Revs[from].Title, q.Revs[to].Title),
+        Content: lineDiff(q.Revs[from].Content, q.Revs[to].Content),
+    }, true, nil
+}
+
+// getAnswerRevisions lists the revisions of an answer with the names of their
+// editors, and counts the revisions of each editor. Editors which don't exist
+// are left with an empty name. An answer without revisions has no revisions
+// and no contributors, like a page past the last one. The editors of
+// anonymous answers are hidden from the viewer, see 'maskHistory'.
+// Params:
+//  1. id - The requested answer ID
+//  2. count - how many revisions to return
+//  3. page - page offset of the revisions (starting from 0)
+//  4. viewer - The viewer of the request, or nil
+//
+// Return:
+//  1. Pointer to an AnswerHistory struct, with the revisions newest first
+//  2. (bool) Does the requested answer exist?
+//  3. (error) Nil or an error
+func (w *Worker) GetAnswerRevisions(id bson.ObjectId, count, page int, viewer *Viewer) (*model.AnswerHistory, bool, error) {
+    // the contributors of all the revisions, the author first:
+    pipe := w.db.Pipe(w.db.Answers, []bson.M{
+        {
+            "$match": bson.M{
+                "_id": id,
+            },
+        },
+        {
+            "$unwind": "$revs",
+        },
+        {
+            "$group": bson.M{
+                "_id":   "$revs.uid",
+                "edits": bson.M{"$sum": 1},
+                "first": bson.M{"$min": "$revs.ts"},
+                "anon":  bson.M{"$first": "$anon"},
+            },
+        },
+        {
+            "$sort": bson.D{{Name: "first", Value: 1}, {Name: "_id", Value: 1}},
+        },
+    })
+    var contributors []struct {
+        model.Contributor `bson:",inline"`
+        Anon              bool `bson:"anon"`
+    }
+    if err := pipe.All(&contributors); err != nil && err != mgo.ErrNotFound {
+        return nil, false, err
+    }
+    h := model.AnswerHistory{
+        Revisions:    make([]model.AnswerRevision, 0),
+        Contributors: make([]model.Contributor, 0, len(contributors)),
+    }
+    if len(contributors) == 0 {
+        // an answer without revisions, or no such answer?
+        n, err := w.db.Answers.FindId(id).SetMaxTime(w.db.MaxTime()).Count()
+        if err != nil || n == 0 {
+            return nil, false, err
+        }
+        return &h, true, nil
+    }
+
+    pipe = w.db.Pipe(w.db.Answers, []bson.M{
+        {
+            "$match": bson.M{
+                "_id": id,
+            },
+        },
+        {
+            "$unwind": bson.M{
+                "path":              "$revs",
+                "includeArrayIndex": "idx",
+            },
+        },
+        {
+            "$sort": bson.D{{Name: "revs.ts", Value: -1}, {Name: "idx", Value: -1}},
+        },
+        {
+            "$skip": count * page,
+        },
+        {
+            "$limit": count,
+        },
+        {
+            "$project": bson.M{
+                "_id":     false,
+                "index":   "$idx",
+                "ts":      "$revs.ts",
+                "uid":     "$revs.uid",
+                "locs":    "$revs.locs",
+                "content": "$revs.content",
+            },
+        },
+    })
+    if err := pipe.All(&h.Revisions); err != nil && err != mgo.ErrNotFound {
+        return nil, false, err
+    }
+
+    uids := make([]bson.ObjectId, 0, len(contributors))
+    for _, c := range contributors {
+        uids = append(uids, c.Uid)
+    }
+    names, err := w.getUserNames(uids)
+    if err != nil {
+        return nil, false, err
+    }
+    for i := range h.Revisions {
+        h.Revisions[i].Udisp = names[h.Revisions[i].Uid]
+    }
+    for _, c := range contributors {
+        c.Udisp = names[c.Uid]
+        h.Contributors = append(h.Contributors, c.Contributor)
+    }
+    sort.SliceStable(h.Contributors, func(i, j int) bool {
+        return h.Contributors[i].Edits > h.Contributors[j].Edits
+    })
+    w.settings.maskHistory(&h, contributors[0].Anon, contributors[0].Uid, viewer)
+    return &h, true, nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+    "github.com/inSituo/Denormalizer/model"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+    "html"
+    "regexp"
+    "strings"
+    "unicode/utf8"
+)
+
+const (
+    // The kind of index needed by the text search.
+    SEARCH_INDEX = "text"
+
+    // Restricts a search to the questions under a location path.
+    OPTION_PATH = "path"
+
+    // Approximate length of a snippet, and how much of the text before the
+    // first match it shows, in bytes. Snippets are cut between words.
+    SNIPPET_LEN     = 200
+    SNIPPET_CONTEXT = 60
+
+    // Surround the matching words of a snippet.
+    SNIPPET_OPEN  = "<em>"
+    SNIPPET_CLOSE = "</em>"
+)
+
+var snippetWord = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+func init() {
+    RegisterCommand(&Command{
+        Name: "QS",
+        Desc: "Questions matching search terms, the most relevant first",
+        Args: []CommandArg{
+            {"TERMS", ARG_STRING},
+            {"COUNT", ARG_INT},
+            {"PAGE", ARG_INT},
+        },
+        Options: append([]string{OPTION_PATH}, viewerOptions...),
+        Parse:   parseSearchArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(searchArgs)
+            return w.SearchQuestions(a.terms, a.count, a.page, a.path, a.viewer)
+        },
+        Tags: questionListTags,
+    })
+}
+
+// searchQuestions generates the denormalized data of the questions matching
+// search terms. The text index covers every revision of the questions, so the
+// questions found by it are only returned if their last revision matches the
+// terms too (see 'textSearch.matches'). The snippet is that of the last
+// revision's content, or of its title if only the title matches.
+// Params:
+//  1. terms - The search terms, in the syntax of MongoDB's '$text' queries
+//  2. count - how many questions to return
+//  3. page - page offset of the questions (starting from 0)
+//  4. path - Only questions under this location path are returned
+//  5. viewer - The viewer of the request, or nil
+//
+// Return:
+//  1. Pointer to an array of SearchResult structs
+//  2. (bool) Always true, no questions is an empty array
+//  3. (error) Nil or an error
+func (w *Worker) SearchQuestions(terms string, count, page int, path []string, viewer *Viewer) (*[]model.SearchResult, bool, error) {
+    match := bson.M{"$text": bson.M{"$search": terms}}
+    if len(path) > 0 {
+        for field, cond := range pathFilter(path) {
+            match[field] = cond
+        }
+    }
+    stages := []bson.M{
+        {
+            "$match": match,
+        },
+        {
+            "$addFields": bson.M{
+                "score": bson.M{"$meta": "textScore"},
+            },
+        },
+        lastRevisionStage,
+    }
+    if len(path) > 0 {
+        stages = append(stages, bson.M{"$match": pathMatch("last_rev.loc.", path)})
+    }
+    stages = append(stages, []bson.M{
+        {
+            "$sort": bson.D{{Name: "score", Value: -1}, {Name: "_id", Value: -1}},
+        },
+        {
+            "$project": bson.M{
+                "score":            true,
+                "last_rev.title":   true,
+                "last_rev.content": true,
+            },
+        },
+    }...)
+    type hit struct {
+        ID      bson.ObjectId          `bson:"_id"`
+        Score   float64                `bson:"score"`
+        LastRev model.QuestionRevision `bson:"last_rev"`
+    }
+    // the hits whose last revision doesn't match are dropped before the
+    // page is selected:
+    search := parseSearch(terms)
+    skip := count * page
+    var hits []hit
+    iter := w.db.Pipe(w.db.Questions, stages).AllowDiskUse().Iter()
+    for len(hits) < count {
+        var h hit
+        if !iter.Next(&h) {
+            break
+        }
+        if !search.matches(h.LastRev.Title + "\n" + h.LastRev.Content) {
+            continue
+        }
+        if skip > 0 {
+            skip--
+            continue
+        }
+        hits = append(hits, h)
+    }
+    if err := iter.Close(); err != nil && err != mgo.ErrNotFound {
+        return nil, false, err
+    }
+    ids := make([]bson.ObjectId, len(hits))
+    for i, h := range hits {
+        ids[i] = h.ID
+    }
+    qs, _, err := w.GetQuestions(ids, viewer)
+    if err != nil {
+        return nil, false, err
+    }
+    words := search.words()
+    rs := make([]model.SearchResult, 0, len(hits))
+    for i, q := range qs {
+        if q == nil {
+            // deleted in the meantime
+            continue
+        }
+        rs = append(rs, model.SearchResult{
+            Question: *q,
+            Score:    hits[i].Score,
+            Snippet:  searchSnippet(q.Title, q.Content, words),
+        })
+    }
+    return &rs, true, nil
+}
+
+// The snippet of a question: that of its content, or of its title if only
+// the title matches the words.
+func searchSnippet(title, content string, words []string) string {
+    if !hasTerm(content, words) && hasTerm(title, words) {
+        return snippet(title, words)
+    }
+    return snippet(content, words)
+}
+
+// A text search, in the syntax of MongoDB's '$text' queries: words, "exact
+// phrases" and -excluded words. Everything is lowercase.
+type textSearch struct {
+    terms    []string
+    phrases  []string
+    excluded []string
+}
+
+func parseSearch(search string) *textSearch {
+    s := &textSearch{}
+    // the parts between quotes are phrases:
+    for i, part := range strings.Split(search, `"`) {
+        part = strings.ToLower(part)
+        if i%2 == 1 {
+            if phrase := strings.Join(strings.Fields(part), " "); phrase != "" {
+                s.phrases = append(s.phrases, phrase)
+            }
+            continue
+        }
+        for _, f := range strings.Fields(part) {
+            words := snippetWord.FindAllString(f, -1)
+            if strings.HasPrefix(f, "-") {
+                s.excluded = append(s.excluded, words...)
+            } else {
+                s.terms = append(s.terms, words...)
+            }
+        }
+    }
+    return s
+}
+
+// The words to highlight: the terms and the words of the phrases.
+func (s *textSearch) words() []string {
+    words := append([]string{}, s.terms...)
+    for _, phrase := range s.phrases {
+        words = append(words, snippetWord.FindAllString(phrase, -1)...)
+    }
+    return words
+}
+
+// Does the text match the search? Like the text index, it must contain the
+// phrases, and one of the terms unless there are phrases, but none of the
+// excluded words. Words match if they start with a term, see 'snippet'.
+func (s *textSearch) matches(text string) bool {
+    lower := strings.Join(strings.Fields(strings.ToLower(text)), " ")
+    for _, phrase := range s.phrases {
+        if !strings.Contains(lower, phrase) {
+            return false
+        }
+    }
+    if hasTerm(lower, s.excluded) {
+        return false
+    }
+    return len(s.phrases) > 0 || hasTerm(lower, s.terms)
+}
+
+// Does a word of the text start with one of the terms?
+func hasTerm(text string, terms []string) bool {
+    matches := termMatcher(terms)
+    for _, word := range snippetWord.FindAllString(text, -1) {
+        if matches(word) {
+            return true
+        }
+    }
+    return false
+}
+
+// A function telling if a word starts with one of the (lowercase) terms.
+func termMatcher(terms []string) func(word string) bool {
+    return func(word string) bool {
+        word = strings.ToLower(word)
+        for _, term := range terms {
+            if strings.HasPrefix(word, term) {
+                return true
+            }
+        }
+        return false
+    }
+}
+
+// A part of 'text' around the first word matching the search terms, with the
+// matching words highlighted. Words match if they start with a term, which
+// roughly follows the stemming of the text index. The snippet is HTML: the
+// text is escaped, only the highlighting is markup.
+func snippet(text string, terms []string) string {
+    matches := termMatcher(terms)
+    words := snippetWord.FindAllStringIndex(text, -1)
+    // start a little before the first match, at the beginning of a word:
+    start := 0
+    for _, loc := range words {
+        if matches(text[loc[0]:loc[1]]) {
+            start = loc[0] - SNIPPET_CONTEXT
+            break
+        }
+    }
+    if start <= 0 {
+        start = 0
+    } else {
+        for _, loc := range words {
+            if loc[0] >= start {
+                start = loc[0]
+                break
+            }
+        }
+    }
+    // and end at the end of a word:
+    end := len(text)
+    if start+SNIPPET_LEN < end {
+        end = start
+        for _, loc := range words {
+            if loc[0] >= start && loc[1] <= start+SNIPPET_LEN {
+                end = loc[1]
+            }
+        }
+        // unless the first word is too long:
+        if end == start {
+            end = start + SNIPPET_LEN
+            for !utf8.RuneStart(text[end]) {
+                end--
+            }
+        }
+    }
+    var b strings.Builder
+    if start > 0 {
+        b.WriteString("…")
+    }
+    pos := start
+    for _, loc := range words {
+        if loc[0] < start || loc[1] > end {
+            continue
+        }
+        if word := text[loc[0]:loc[1]]; matches(word) {
+            b.WriteString(html.EscapeString(text[pos:loc[0]]))
+            b.WriteString(SNIPPET_OPEN + html.EscapeString(word) + SNIPPET_CLOSE)
+            pos = loc[1]
+        }
+    }
+    b.WriteString(html.EscapeString(text[pos:end]))
+    if end < len(text) {
+        b.WriteString("…")
+    }
+    return b.String()
+}
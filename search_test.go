@@ -0,0 +1,81 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestSearchTerms(t *testing.T) {
+    search := parseSearch(`Parking "Tel  Aviv" -beach`)
+    if words := search.words(); strings.Join(words, ",") != "parking,tel,aviv" {
+        t.Error("unexpected words", words)
+    }
+    if len(search.phrases) != 1 || search.phrases[0] != "tel aviv" || len(search.excluded) != 1 {
+        t.Error("unexpected search", search)
+    }
+}
+
+func TestSearchMatches(t *testing.T) {
+    cases := []struct {
+        search string
+        text   string
+        match  bool
+    }{
+        {"parking", "Where can I park?\nParking lots", true},
+        {"parking", "Where can I stop?\nNowhere", false},
+        {"parking -beach", "Parking near the beaches", false},
+        {`"tel aviv" parking`, "Where in Tel\nAviv?", true},
+        {`"tel aviv" parking`, "Parking in Aviv", false},
+    }
+    for _, c := range cases {
+        if parseSearch(c.search).matches(c.text) != c.match {
+            t.Error("expected", c.match, "for", c.search, c.text)
+        }
+    }
+}
+
+func TestSnippet(t *testing.T) {
+    terms := []string{"park"}
+    if s := snippet("Where can I park near the beach?", terms); s != "Where can I <em>park</em> near the beach?" {
+        t.Error("unexpected snippet", s)
+    }
+    if s := snippet("Parking is hard, parks are nice", terms); s != "<em>Parking</em> is hard, <em>parks</em> are nice" {
+        t.Error("unexpected snippet", s)
+    }
+
+    // long texts are cut between words around the first match:
+    long := strings.Repeat("lorem ipsum ", 30) + "park here " + strings.Repeat("dolor sit ", 30)
+    s := snippet(long, terms)
+    if !strings.HasPrefix(s, "…lorem") && !strings.HasPrefix(s, "…ipsum") {
+        t.Error("snippet doesn't start at a word", s)
+    }
+    if !strings.HasSuffix(s, "…") || !strings.Contains(s, "<em>park</em> here") {
+        t.Error("unexpected snippet", s)
+    }
+    if len(s) > SNIPPET_LEN+len(SNIPPET_OPEN+SNIPPET_CLOSE)+2*len("…") {
+        t.Error("snippet too long", len(s))
+    }
+
+    // without a match, the snippet is the beginning of the text:
+    if s := snippet(long, []string{"nothing"}); !strings.HasPrefix(s, "lorem ipsum") {
+        t.Error("unexpected snippet", s)
+    }
+    // the text is escaped, only the highlighting is markup:
+    if s := snippet(`<script>park("x & y")</script>`, terms); s != "&lt;script&gt;<em>park</em>(&#34;x &amp; y&#34;)&lt;/script&gt;" {
+        t.Error("unescaped snippet", s)
+    }
+    // a word longer than a snippet is cut:
+    if s := snippet(strings.Repeat("é", SNIPPET_LEN), terms); !strings.HasSuffix(s, "é…") {
+        t.Error("unexpected snippet", s)
+    }
+}
+
+func TestSearchSnippet(t *testing.T) {
+    words := []string{"park"}
+    if s := searchSnippet("Parking?", "Where can I park?", words); s != "Where can I <em>park</em>?" {
+        t.Error("expected the content's snippet", s)
+    }
+    if s := searchSnippet("Parking?", "Where can I stop?", words); s != "<em>Parking</em>?" {
+        t.Error("expected the title's snippet", s)
+    }
+}
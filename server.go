@@ -1,6 +1,7 @@
 package main
 
 import (
+    "errors"
     "fmt"
     "github.com/inSituo/LeveledLogger"
     zmq "github.com/pebbe/zmq4"
@@ -9,144 +10,348 @@ import (
     "time"
 )
 
-const (
-    POLL_TIMEOUT  = 1 * time.Millisecond
-    THREADS_SLEEP = 5 * time.Millisecond
-)
-
 type Server struct {
-    port     int
+    conf     *DenormConf
     log      *LeveledLogger.Logger
     ll_level int
-    dbconf   *MongoConf
-    wn       int
-    wbuff    int
+
+    // Closed by 'Shutdown' to signal 'Run' to drain and return.
+    stopc    chan bool
+    stopOnce sync.Once
+
+    // Signals 'Run' to reload the allowed CURVE clients.
+    reloadc chan bool
 }
 
-func NewServer(port int, wn int, wbuff int, dbconf *MongoConf, ll_level int) *Server {
+func NewServer(conf *DenormConf, ll_level int) *Server {
     return &Server{
-        port:     port,
+        conf:     conf,
         log:      LeveledLogger.New(os.Stdout, ll_level),
-        dbconf:   dbconf,
-        wn:       wn,
-        wbuff:    wbuff,
         ll_level: ll_level,
+        stopc:    make(chan bool),
+        reloadc:  make(chan bool, 1),
+    }
+}
+
+// Shut down the server: stop accepting new requests and let the workers
+// finish the requests already received. 'Run' returns once every reply was
+// sent, or with an error if the grace period expired first.
+// Safe to call from any goroutine, more than once.
+func (s *Server) Shutdown() {
+    s.stopOnce.Do(func() { close(s.stopc) })
+}
+
+// Read the list of allowed CURVE clients again. Does nothing if CURVE is not
+// enabled. Safe to call from any goroutine.
+func (s *Server) Reload() {
+    select {
+    case s.reloadc <- true:
+    default:
+        // a reload is already pending
     }
 }
 
+// Run the server until 'Shutdown' is called.
 func (s *Server) Run() error {
     iname := "Server.Run"
-    addr := fmt.Sprintf("tcp://*:%d", s.port)
+    addr := fmt.Sprintf("tcp://*:%d", *s.conf.port)
+    wn := *s.conf.workers
+    wbuff := *s.conf.wbuff
+    grace := *s.conf.grace
+
+    dispatcher, err := NewDispatcher(*s.conf.dispatch)
+    if err != nil {
+        return err
+    }
+    ttls, err := parseTTLs(*s.conf.cachettl)
+    if err != nil {
+        return err
+    }
+    cache := NewCache(*s.conf.cachesize, ttls)
+    coalescer := NewCoalescer()
+    settings, err := newSettings(s.conf)
+    if err != nil {
+        return err
+    }
+    if *s.conf.secretfile == "" {
+        s.log.Warn(iname, "no secret set, cursors will be invalid after a restart")
+    }
+
+    var curve *Curve
+    if *s.conf.curvekey != "" {
+        if *s.conf.curveclients == "" {
+            return errors.New("CURVE requires a list of allowed clients")
+        }
+        if curve, err = NewCurve(*s.conf.curvekey, *s.conf.curveclients, s.ll_level); err != nil {
+            return err
+        }
+    }
 
     s.log.Info(
         iname,
         "connecting to MongoDB",
-        *s.dbconf.Host,
-        *s.dbconf.Port,
-        *s.dbconf.DB,
+        *s.conf.mongo.Host,
+        *s.conf.mongo.Port,
+        *s.conf.mongo.DB,
     )
-    db, err := NewDB(s.dbconf)
+    db, err := NewDB(&s.conf.mongo)
     if err != nil {
         return err
     }
     defer db.Close()
 
-    s.log.Debug(iname, "creating frontend socket")
-    felock := sync.Mutex{}
+    if settings.geoReady, err = CheckGeo(db, settings.geoField); err != nil {
+        s.log.Warn(iname, "unable to check the questions' geo field, QN requests will fail", err)
+    } else if !settings.geoReady {
+        s.log.Warn(iname, "no 2dsphere index on the questions' field, or no question has it (see -geobackfill), QN requests will fail", settings.geoField)
+    } else if !*s.conf.watch {
+        s.log.Warn(iname, "not watching for changes, the questions' geo field must be kept up to date by the application (see -watch)")
+    }
+    if settings.questionAuthors, err = CheckQuestionAuthors(db); err != nil {
+        s.log.Warn(iname, "unable to check the questions' revisions, U won't count the questions", err)
+    } else if !settings.questionAuthors {
+        s.log.Warn(iname, "the questions' revisions have no uid, U won't count the questions")
+    }
+    if ok, err := HasIndex(db.Questions, SEARCH_INDEX, "revs.title"); err != nil {
+        s.log.Warn(iname, "unable to list the indexes of the questions", err)
+    } else if !ok {
+        s.log.Warn(iname, "no text index on the questions' revisions, QS requests will fail")
+    }
+
+    if *s.conf.watch {
+        geoField := ""
+        if settings.geoReady {
+            geoField = settings.geoField
+        }
+        if cache.size > 0 || geoField != "" {
+            watcher := NewWatcher(db, cache, geoField, *s.conf.resume, s.ll_level)
+            go watcher.Run()
+            defer watcher.Stop()
+        } else {
+            s.log.Warn(iname, "the cache is disabled and QN is unavailable, not watching for changes")
+        }
+    }
+
+    s.log.Debug(iname, "creating frontend")
     context, err := zmq.NewContext()
     if err != nil {
         return err
     }
-    frontend, err := context.NewSocket(zmq.ROUTER)
-    if err != nil {
-        return err
+
+    if curve != nil {
+        s.log.Info(iname, "CURVE enabled, starting authentication handler")
+        handler, err := curve.Bind(context)
+        if err != nil {
+            context.Term()
+            return err
+        }
+        // the handler returns once the context is terminated:
+        go curve.Run(handler)
+        go s.reload(curve)
     }
-    defer frontend.Close()
+
+    outgoing := make(chan *Product, wbuff*wn)
+    incoming := make(chan *Work, wbuff*wn)
+
     s.log.Debug(iname, "binding frontend socket", addr)
-    if err := frontend.Bind(
-        fmt.Sprintf("tcp://*:%d", s.port),
-    ); err != nil {
+    frontend, err := NewFrontend(context, addr, incoming, outgoing, curve, s.ll_level)
+    if err != nil {
+        context.Term()
         return err
     }
+    // replies still queued when the frontend closes are dropped after the
+    // grace period:
+    frontend.SetLinger(grace)
 
-    outgoing := make(chan *Product, s.wbuff*s.wn)
-    incoming := make(chan []string, s.wbuff*s.wn)
-    workq := make(chan *Work, s.wbuff*s.wn)
-
-    // pool of worker goroutines
+    // pool of worker goroutines, each with its own buffer
     s.log.Debug(iname, "creating workers pool")
-    for i := 0; i < s.wn; i++ {
-        worker := NewWorker(i, workq, outgoing, db, s.ll_level)
-        go worker.Run()
-        defer worker.Stop()
+    workers := make([]*Worker, wn)
+    wg := sync.WaitGroup{}
+    for i := 0; i < wn; i++ {
+        worker := NewWorker(i, wbuff, outgoing, db, settings, cache, coalescer, s.ll_level)
+        workers[i] = worker
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            worker.Run()
+        }()
     }
-
-    // receiver:
+    // once all the workers and batches are done, no more products will be
+    // produced. batches are only started before the workers are shut down.
+    batches := sync.WaitGroup{}
     go func() {
-        poller := zmq.NewPoller()
-        poller.Add(frontend, zmq.POLLIN)
-        s.log.Info(iname, "listening to incoming requests", addr)
-        for {
-            felock.Lock()
-            polled, err := poller.Poll(POLL_TIMEOUT)
-            if err == nil {
-                if len(polled) > 0 {
-                    msg, err := frontend.RecvMessage(0)
-                    if err == nil {
-                        incoming <- msg
-                    } else {
-                        s.log.Warn(iname, "failed to receive incoming message", err)
-                    }
-                }
-            } else {
-                s.log.Warn(iname, "failed to poll socket", err)
-            }
-            felock.Unlock()
-            // give other threads a chance to obtain the lock:
-            time.Sleep(THREADS_SLEEP)
-        }
+        wg.Wait()
+        batches.Wait()
+        close(outgoing)
     }()
 
-    // dispatcher
-    go func() {
-        for {
-            msg := <-incoming
-            s.log.Debug(iname, "message received", msg)
-            if len(msg) < 3 {
-                s.log.Debug(iname, "not enough message parts", len(msg))
-                if len(msg) == 2 {
-                    outgoing <- &Product{
-                        id:      msg,
-                        success: false,
-                        empty:   false,
-                        payload: []byte("no task specified"),
-                    }
-                }
-                continue
-            }
-            work := Work{
-                id:     msg[:2],
-                params: msg[2:],
-            }
-            workq <- &work
+    go s.dispatch(dispatcher, coalescer, workers, incoming, outgoing, &batches)
+
+    // the HTTP gateway shares the incoming queue with the frontend:
+    var gateway *Gateway
+    gwdone := make(chan error, 1)
+    if *s.conf.http > 0 {
+        gateway = NewGateway(*s.conf.http, incoming, s.ll_level)
+        go func() { gwdone <- gateway.Run() }()
+    }
+
+    // the frontend owns the socket from now on. it relays the replies
+    // pending in the outgoing queue as soon as they are produced.
+    done := make(chan error, 1)
+    go func() { done <- frontend.Run() }()
+
+    select {
+    case err := <-done:
+        // the frontend failed. the workers are left behind, but the process
+        // is about to exit anyway.
+        return err
+    case err := <-gwdone:
+        // the gateway only returns before the shutdown if it failed:
+        return err
+    case <-s.stopc:
+    }
+
+    // shutting down: the frontend closes the incoming queue, the dispatcher
+    // then closes the workers buffers, the workers drain them and the
+    // frontend returns once the last product was sent.
+    s.log.Info(iname, "shutting down", grace)
+    // the gateway must be done with the incoming queue before the frontend
+    // closes it:
+    if gateway != nil {
+        if err := gateway.Shutdown(grace); err != nil {
+            return err
         }
-    }()
+    }
+    if err := frontend.Stop(); err != nil {
+        return err
+    }
+    select {
+    case err := <-done:
+        if err != nil {
+            return err
+        }
+    case <-time.After(grace):
+        return errors.New("grace period expired before all requests were done")
+    }
+    s.log.Debug(iname, "terminating ZeroMQ context")
+    if err := context.Term(); err != nil {
+        return err
+    }
+    s.log.Info(iname, "all requests are done")
+    return nil
+}
 
-    // reply to requests pending in the replies quque
-    s.log.Debug(iname, "waiting for payloads")
+// Reload the allowed CURVE clients whenever 'Reload' is called, until the
+// server shuts down. A list which fails to load leaves the previous one in
+// place.
+func (s *Server) reload(curve *Curve) {
     for {
-        prod := <-outgoing
-        s.log.Debug(iname, "sending reply", prod)
-        felock.Lock()
-        _, err := frontend.SendMessage(prod.id, prod.success, prod.empty, prod.payload)
-        felock.Unlock()
-        if err != nil {
-            s.log.Warn(iname, "unable to send reply", err)
+        select {
+        case <-s.reloadc:
+            if err := curve.Reload(); err != nil {
+                s.log.Warn("Server.reload", "failed to reload allowed clients", err)
+            }
+        case <-s.stopc:
+            return
         }
-        // give other threads a chance to obtain the lock:
-        time.Sleep(THREADS_SLEEP)
     }
+}
+
+// Take requests from the incoming queue and push each of them into the
+// buffer of the worker selected by the dispatch strategy. Requests identical
+// to one in flight are not dispatched, but wait for its product.
+// Batch requests are split into their commands, which are dispatched like any
+// other request; the products of a batch are collected by the goroutines of
+// 'batches'.
+func (s *Server) dispatch(
+    dispatcher Dispatcher,
+    coalescer *Coalescer,
+    workers []*Worker,
+    incoming chan *Work,
+    outgoing chan *Product,
+    batches *sync.WaitGroup,
+) {
+    iname := "Server.dispatch"
+    // shut the workers down once the frontend closes the incoming queue:
+    defer func() {
+        for _, w := range workers {
+            close(w.workq)
+        }
+    }()
+    submit := func(work *Work) {
+        if !coalescer.Join(work) {
+            s.log.Debug(iname, "coalesced with a request in flight", work.params)
+            return
+        }
+        worker := dispatcher.Select(work, workers)
+        worker.workq <- work
+    }
+    for work := range incoming {
+        s.log.Debug(iname, "request received", work.params)
+        if len(work.params) == 0 {
+            work.fail(badArgs("No command specified"), outgoing)
+            continue
+        }
+        if work.params[0] == BATCH_COMMAND {
+            s.batch(work, submit, outgoing, batches)
+            continue
+        }
+        params, opts := splitOptions(work.params)
+        if err := s.prepare(work, params, opts); err != nil {
+            work.fail(err, outgoing)
+            continue
+        }
+        submit(work)
+    }
+}
+
+// Set the parameters, options, deadline and key of a work item before it is
+// dispatched.
+func (s *Server) prepare(work *Work, params []string, opts map[string]string) error {
+    timeout, err := timeoutOption(opts, *s.conf.timeout)
+    if err != nil {
+        return err
+    }
+    work.params = params
+    work.opts = opts
+    work.deadline = time.Now().Add(timeout)
+    work.key = requestKey(params, opts)
     return nil
+}
 
-    // now the deferred worker.Stop and frontend.Close will be called
+// Dispatch the commands of a batch request, each as its own work item, and
+// reply with all their products once they are done.
+func (s *Server) batch(
+    work *Work,
+    submit func(*Work),
+    outgoing chan *Product,
+    batches *sync.WaitGroup,
+) {
+    cmds, bopts, err := splitBatch(work.params)
+    if err != nil {
+        work.fail(err, outgoing)
+        return
+    }
+    subs := make([]*Work, len(cmds))
+    for i, cmd := range cmds {
+        sub := &Work{replyc: make(chan *Product, 1)}
+        subs[i] = sub
+        params, opts := splitOptions(cmd)
+        if err := s.prepare(sub, params, mergeOptions(opts, bopts)); err != nil {
+            // only this command fails:
+            sub.fail(err, outgoing)
+            continue
+        }
+        submit(sub)
+    }
+    // the outgoing queue stays open until every batch is collected:
+    batches.Add(1)
+    go func() {
+        defer batches.Done()
+        prods := make([]*Product, len(subs))
+        for i, sub := range subs {
+            prods[i] = <-sub.replyc
+        }
+        work.reply(&Product{success: true, parts: prods}, outgoing)
+    }()
 }
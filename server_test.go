@@ -1,72 +1,209 @@
 package main
 
 import (
+    "fmt"
     "github.com/inSituo/LeveledLogger"
     zmq "github.com/pebbe/zmq4"
-    "os"
+    "sort"
+    "sync"
     "testing"
     "time"
 )
 
-func TestServer(t *testing.T) {
-    iname := "ServerTest"
-
+func testConf() *DenormConf {
     port := 27017
     host := "127.0.0.1"
     dbname := "insituo-tst"
     cusers := "users"
     cquestions := "questions"
     canswers := "answers"
-
-    log := LeveledLogger.New(os.Stdout, LeveledLogger.LL_DEBUG)
-    db, err := NewDB(MongoConf{
-        Port:       &port,
-        Host:       &host,
-        DB:         &dbname,
-        CUsers:     &cusers,
-        CQuestions: &cquestions,
-        CAnswers:   &canswers,
-    })
-    if err != nil {
-        log.Error(iname, "failed to create a new db", err) // this will panic
+    ccomments := "comments"
+    sport := 1234
+    workers := 5
+    wbuff := 10
+    dispatch := DISPATCH_LEAST_LOADED
+    grace := 5 * time.Second
+    timeout := 5 * time.Second
+    cachesize := 100
+    cachettl := "Q=1s,QJ=1s"
+    watch := false
+    resume := ""
+    http := 0
+    maxids := 100
+    secretfile := ""
+    viewerfile := ""
+    anonname := "Anonymous"
+    geofield := "geo"
+    userfields := ""
+    curvekey := ""
+    curveclients := ""
+    debug := true
+    return &DenormConf{
+        mongo: MongoConf{
+            Port:       &port,
+            Host:       &host,
+            DB:         &dbname,
+            CUsers:     &cusers,
+            CQuestions: &cquestions,
+            CAnswers:   &canswers,
+            CComments:  &ccomments,
+        },
+        port:         &sport,
+        workers:      &workers,
+        wbuff:        &wbuff,
+        dispatch:     &dispatch,
+        grace:        &grace,
+        timeout:      &timeout,
+        cachesize:    &cachesize,
+        cachettl:     &cachettl,
+        watch:        &watch,
+        resume:       &resume,
+        http:         &http,
+        maxids:       &maxids,
+        secretfile:   &secretfile,
+        viewerfile:   &viewerfile,
+        anonname:     &anonname,
+        geofield:     &geofield,
+        userfields:   &userfields,
+        curvekey:     &curvekey,
+        curveclients: &curveclients,
+        debug:        &debug,
     }
-    defer db.Close()
+}
 
-    server, err := NewServer(1234, log, db)
+func TestServer(t *testing.T) {
+    conf := testConf()
+    db, err := NewDB(&conf.mongo)
     if err != nil {
-        log.Error(iname, "failed to create server", err) // this will panic
+        t.Skip("MongoDB is not available", err)
     }
+    db.Close()
 
-    go func() {
-        err = server.Run(10)
-        log.Error(iname, "server stopped", err) // this will panic
-    }()
+    server := NewServer(conf, LeveledLogger.LL_DEBUG)
+    errc := make(chan error, 1)
+    go func() { errc <- server.Run() }()
     time.Sleep(1000 * time.Millisecond)
-    return
+
     // simulate clients load - 15 clients every 100ms
-    for {
+    wg := sync.WaitGroup{}
+    for round := 0; round < 10; round++ {
         for i := 0; i < 15; i++ {
+            wg.Add(1)
             go func() {
+                defer wg.Done()
                 client, err := zmq.NewSocket(zmq.REQ)
                 if err != nil {
                     t.Error(err)
-                    t.Fail()
                     return
                 }
                 defer client.Close()
 
                 client.Connect("tcp://127.0.0.1:1234")
 
-                client.SendMessage("questionJoins", "53fb63a4472dcb6b32e99260", "5", "1")
+                client.SendMessage("QJ", "53fb63a4472dcb6b32e99260", "5", "1")
 
-                _, err = client.RecvMessage(0)
+                reply, err := client.RecvMessage(0)
                 if err != nil {
                     t.Error(err)
-                    t.Fail()
+                    return
+                }
+                if len(reply) != 3 {
+                    t.Error("unexpected reply", reply)
                 }
             }()
         }
         time.Sleep(100 * time.Millisecond)
     }
+    wg.Wait()
+    select {
+    case err := <-errc:
+        t.Error("server stopped", err)
+    default:
+    }
+
+    server.Shutdown()
+    if err := <-errc; err != nil {
+        t.Error("shutdown failed", err)
+    }
+}
 
+// BenchmarkFrontend measures the round trip through the frontend alone: an
+// echo goroutine stands in for the dispatcher and the workers, so no
+// database is needed. Reports throughput and the 99th percentile latency.
+func BenchmarkFrontend(b *testing.B) {
+    context, err := zmq.NewContext()
+    if err != nil {
+        b.Fatal(err)
+    }
+    incoming := make(chan *Work, 1000)
+    outgoing := make(chan *Product, 1000)
+    addr := fmt.Sprintf("tcp://127.0.0.1:%d", 17710)
+    frontend, err := NewFrontend(context, addr, incoming, outgoing, nil, LeveledLogger.LL_INFO)
+    if err != nil {
+        b.Fatal(err)
+    }
+    done := make(chan error)
+    go func() { done <- frontend.Run() }()
+    // the echo goroutine returns once the frontend closes the incoming queue:
+    echoed := make(chan bool)
+    go func() {
+        defer close(echoed)
+        for work := range incoming {
+            outgoing <- &Product{
+                id:      work.id,
+                success: true,
+                empty:   true,
+            }
+        }
+    }()
+
+    lock := sync.Mutex{}
+    latencies := make([]time.Duration, 0, b.N)
+    b.ResetTimer()
+    start := time.Now()
+    b.RunParallel(func(pb *testing.PB) {
+        client, err := context.NewSocket(zmq.REQ)
+        if err != nil {
+            b.Error(err)
+            return
+        }
+        defer client.Close()
+        client.Connect(addr)
+        mine := make([]time.Duration, 0)
+        for pb.Next() {
+            sent := time.Now()
+            if _, err := client.SendMessage("Q", "53fb63a4472dcb6b32e99260"); err != nil {
+                b.Error(err)
+                return
+            }
+            if _, err := client.RecvMessage(0); err != nil {
+                b.Error(err)
+                return
+            }
+            mine = append(mine, time.Since(sent))
+        }
+        lock.Lock()
+        latencies = append(latencies, mine...)
+        lock.Unlock()
+    })
+    elapsed := time.Since(start)
+    b.StopTimer()
+
+    // the port must be released before the next round of the benchmark. the
+    // frontend only returns once the outgoing queue is closed, which must
+    // wait for the last product of the echo goroutine:
+    frontend.Stop()
+    <-echoed
+    close(outgoing)
+    if err := <-done; err != nil {
+        b.Error(err)
+    }
+
+    if len(latencies) == 0 {
+        return
+    }
+    sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+    p99 := latencies[len(latencies)*99/100]
+    b.ReportMetric(float64(len(latencies))/elapsed.Seconds(), "msgs/s")
+    b.ReportMetric(float64(p99.Microseconds()), "p99-µs")
 }
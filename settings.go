@@ -0,0 +1,88 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "strings"
+)
+
+// Settings of the commands, set from the flags and the checks of the database
+// when the server starts. The workers share them, and pass them to the
+// commands' parsers; they don't change while the server runs.
+type Settings struct {
+    // Maximum number of IDs accepted by 'parseOidsArgs'.
+    maxIds int
+
+    // The key of the HMAC which signs the cursors, see 'cursorKey'.
+    cursorKey []byte
+
+    // The key of the HMAC which signs the viewer options, see 'parseViewer'.
+    // Viewer options are rejected if it's empty.
+    viewerKey []byte
+
+    // Placeholder for the names of the authors of anonymous answers, see
+    // 'maskAnonymous'.
+    anonName string
+
+    // Field of the questions with the GeoJSON point of their location, see
+    // 'GetNearQuestions'.
+    geoField string
+
+    // Can QN be answered? Set by the server once it has checked the geo
+    // field, see 'CheckGeo'.
+    geoReady bool
+
+    // Fields of the users returned by 'U' in addition to their name, see
+    // 'parseUserFields'.
+    userFields []string
+
+    // Do the revisions of the questions have the 'uid' of their editor? Set
+    // by the server once it has checked, see 'CheckQuestionAuthors'.
+    questionAuthors bool
+}
+
+// Build the settings of the commands from the server's configuration.
+func newSettings(conf *DenormConf) (*Settings, error) {
+    secret, err := readSecret(*conf.secretfile)
+    if err != nil {
+        return nil, err
+    }
+    key, err := cursorKey(secret)
+    if err != nil {
+        return nil, err
+    }
+    viewerKey, err := readSecret(*conf.viewerfile)
+    if err != nil {
+        return nil, err
+    }
+    fields, err := parseUserFields(*conf.userfields)
+    if err != nil {
+        return nil, err
+    }
+    return &Settings{
+        maxIds:     *conf.maxids,
+        cursorKey:  key,
+        viewerKey:  []byte(viewerKey),
+        anonName:   *conf.anonname,
+        geoField:   *conf.geofield,
+        userFields: fields,
+    }, nil
+}
+
+// Read a secret from the first line of a file, or return an empty secret if
+// no file is given. Secrets are read from files rather than passed as flags,
+// since the command line of a process is visible to other users.
+func readSecret(path string) (string, error) {
+    if path == "" {
+        return "", nil
+    }
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return "", err
+    }
+    secret := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+    if secret == "" {
+        return "", fmt.Errorf("%s: empty secret", path)
+    }
+    return secret, nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+    "fmt"
+    "github.com/inSituo/Denormalizer/model"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+    "strings"
+)
+
+func init() {
+    RegisterCommand(&Command{
+        Name:    "U",
+        Desc:    "User profile",
+        Args:    []CommandArg{{"ID", ARG_OID}},
+        Options: viewerOptions,
+        Parse:   parseOidArgs,
+        Handle: func(w *Worker, args interface{}) (interface{}, bool, error) {
+            a := args.(oidArgs)
+            return w.GetUserProfile(a.id, a.viewer)
+        },
+        Tags: func(params []string) []string {
+            return []string{profileTag(params[1])}
+        },
+    })
+}
+
+// Parse the comma separated fields of the '-userfields' flag. A field can't
+// be listed twice, or with one of its sub-fields (such as 'profile' and
+// 'profile.bio'): MongoDB rejects such projections.
+func parseUserFields(spec string) ([]string, error) {
+    fields := []string{}
+    for _, f := range strings.Split(spec, ",") {
+        f = strings.TrimSpace(f)
+        if f == "" {
+            continue
+        }
+        if strings.HasPrefix(f, "$") || f == "_id" || f == "name" {
+            return nil, fmt.Errorf("invalid user field '%s'", f)
+        }
+        for _, other := range fields {
+            if f == other || strings.HasPrefix(f, other+".") || strings.HasPrefix(other, f+".") {
+                return nil, fmt.Errorf("overlapping user fields '%s' and '%s'", other, f)
+            }
+        }
+        fields = append(fields, f)
+    }
+    return fields, nil
+}
+
+// CheckQuestionAuthors tells if the revisions of the questions have the 'uid'
+// of their editor, which 'U' needs to count the user's questions. It assumes
+// they do if there are no questions yet.
+func CheckQuestionAuthors(db *DB) (bool, error) {
+    n, err := db.Questions.Find(bson.M{"revs.uid": bson.M{"$exists": true}}).Limit(1).Count()
+    if err != nil || n > 0 {
+        return n > 0, err
+    }
+    n, err = db.Questions.Find(nil).Limit(1).Count()
+    return n == 0, err
+}
+
+// getUserProfile generates a user's profile: the user's name and extra
+// fields, and counts of the user's questions, answers, the thumbs up and
+// thanks they received, and the questions the user joined. The author of a
+// question or an answer is the user of its first revision. The questions are
+// only counted if their revisions have the user's 'uid', see
+// 'CheckQuestionAuthors'.
+// Params:
+//  1. id - The requested user ID
+//  2. viewer - The viewer of the request, or nil
+//
+// Return:
+//  1. Pointer to a UserProfile struct
+//  2. (bool) Does the requested user exist?
+//  3. (error) Nil or an error
+func (w *Worker) GetUserProfile(id bson.ObjectId, viewer *Viewer) (*model.UserProfile, bool, error) {
+    sel := bson.M{"_id": true, "name": true}
+    for _, f := range w.settings.userFields {
+        sel[f] = true
+    }
+    var user bson.M
+    query := w.db.Users.FindId(id).Select(sel).SetMaxTime(w.db.MaxTime())
+    if err := query.One(&user); err != nil {
+        if err != mgo.ErrNotFound {
+            return nil, false, err
+        }
+        return nil, false, nil
+    }
+    p := model.UserProfile{ID: id, Fields: make(map[string]interface{})}
+    p.Name, _ = user["name"].(string)
+    for _, f := range w.settings.userFields {
+        // dotted fields are returned as sub-documents:
+        v := interface{}(user)
+        for _, part := range strings.Split(f, ".") {
+            if doc, ok := v.(bson.M); ok {
+                v = doc[part]
+            } else {
+                v = nil
+            }
+        }
+        p.Fields[f] = v
+    }
+
+    if w.settings.questionAuthors {
+        n, err := w.countAuthored(w.db.Questions, id, nil)
+        if err != nil {
+            return nil, false, err
+        }
+        p.Questions = &n
+    }
+    var answers struct {
+        N        int `bson:"n"`
+        Thumbups int `bson:"thumbups"`
+        Thanks   int `bson:"thanks"`
+    }
+    // anonymous answers are only counted for the user and the moderators:
+    match := bson.M{}
+    if !viewer.trusts(id) {
+        match["anon"] = bson.M{"$ne": true}
+    }
+    pipe := w.db.Pipe(w.db.Answers, authoredPipeline(id, match, bson.M{
+        "thumbups": bson.M{"$sum": "$thumbups"},
+        "thanks":   bson.M{"$sum": "$thanks"},
+    }))
+    if err := pipe.One(&answers); err != nil && err != mgo.ErrNotFound {
+        return nil, false, err
+    }
+    p.Answers, p.Thumbups, p.Thanks = answers.N, answers.Thumbups, answers.Thanks
+    var err error
+    if p.Joins, err = w.db.Questions.Find(bson.M{"juids": id}).SetMaxTime(w.db.MaxTime()).Count(); err != nil {
+        return nil, false, err
+    }
+    return &p, true, nil
+}
+
+// The number of documents of the collection written by the user.
+func (w *Worker) countAuthored(c *mgo.Collection, uid bson.ObjectId, match bson.M) (int, error) {
+    var res struct {
+        N int `bson:"n"`
+    }
+    if err := w.db.Pipe(c, authoredPipeline(uid, match, bson.M{})).One(&res); err != nil && err != mgo.ErrNotFound {
+        return 0, err
+    }
+    return res.N, nil
+}
+
+// The aggregation pipeline counting the documents matching 'match' whose
+// first revision was written by 'uid', in a single document with the count
+// 'n' and the 'sums' of the documents' thumbs up and thanks.
+func authoredPipeline(uid bson.ObjectId, match bson.M, sums bson.M) []bson.M {
+    // only documents with a revision by the user can have their first
+    // revision by the user:
+    m := bson.M{"revs.uid": uid}
+    for k, v := range match {
+        m[k] = v
+    }
+    group := bson.M{"_id": nil, "n": bson.M{"$sum": 1}}
+    for k, v := range sums {
+        group[k] = v
+    }
+    return []bson.M{
+        {
+            "$match": m,
+        },
+        {
+            "$unwind": "$revs",
+        },
+        {
+            "$sort": bson.M{
+                "revs.ts": 1,
+            },
+        },
+        {
+            "$group": bson.M{
+                "_id":      "$_id",
+                "fuid":     bson.M{"$first": "$revs.uid"},
+                "thumbups": bson.M{"$first": bson.M{"$size": bson.M{"$ifNull": []interface{}{"$thupsuids", []interface{}{}}}}},
+                "thanks":   bson.M{"$first": bson.M{"$size": bson.M{"$ifNull": []interface{}{"$thnksuids", []interface{}{}}}}},
+            },
+        },
+        {
+            "$match": bson.M{
+                "fuid": uid,
+            },
+        },
+        {
+            "$group": group,
+        },
+    }
+}
+
+// getUserNames looks up the display names of users with a single query.
+// Duplicate IDs are only looked up once. Users which don't exist are left out
+// of the result, it's up to the caller to decide if that's an error.
+// Params: uids - The IDs of the users
+// Return:
+//  1. Map of user IDs to display names
+//  2. (error) Nil or an error
+func (w *Worker) getUserNames(uids []bson.ObjectId) (map[bson.ObjectId]string, error) {
+    names := make(map[bson.ObjectId]string)
+    unique := make(map[bson.ObjectId]bool)
+    for _, uid := range uids {
+        unique[uid] = true
+    }
+    if len(unique) == 0 {
+        return names, nil
+    }
+    ids := make([]bson.ObjectId, 0, len(unique))
+    for uid := range unique {
+        ids = append(ids, uid)
+    }
+    query := w.db.Users.
+        Find(bson.M{"_id": bson.M{"$in": ids}}).
+        Select(bson.M{"_id": true, "name": true}).
+        SetMaxTime(w.db.MaxTime())
+    users := make([]struct {
+        ID   bson.ObjectId `bson:"_id"`
+        Name string        `bson:"name"`
+    }, 0, len(ids))
+    if err := query.All(&users); err != nil && err != mgo.ErrNotFound {
+        return nil, err
+    }
+    for _, v := range users {
+        names[v.ID] = v.Name
+    }
+    return names, nil
+}
+
+// The IDs of the users who joined a question, and their names, in the order
+// of 'juids'. Users which don't exist are left out.
+func questionJoins(juids []bson.ObjectId, names map[bson.ObjectId]string) []model.QuestionJoin {
+    qjs := make([]model.QuestionJoin, 0, len(juids))
+    for _, uid := range juids {
+        if name, found := names[uid]; found {
+            qjs = append(qjs, model.QuestionJoin{Uid: uid, Udisp: name})
+        }
+    }
+    return qjs
+}
+
+// The authors of comments.
+func commentUids(cmts []model.Comment) []bson.ObjectId {
+    uids := make([]bson.ObjectId, 0, len(cmts))
+    for _, c := range cmts {
+        uids = append(uids, c.Uid)
+    }
+    return uids
+}
+
+// Fill in the names of the comments' authors. Authors which don't exist are
+// left with an empty name.
+func setCommentNames(cmts []model.Comment, names map[bson.ObjectId]string) {
+    for i := range cmts {
+        cmts[i].Udisp = names[cmts[i].Uid]
+    }
+}
+
+// The first and last authors of answers.
+func answerUids(as []model.Answer) []bson.ObjectId {
+    uids := make([]bson.ObjectId, 0, 2*len(as))
+    for _, a := range as {
+        uids = append(uids, a.Fuid, a.Luid)
+    }
+    return uids
+}
+
+// The answers whose first and last authors exist, see 'setAnswerNames'.
+// Reuses the storage of 'as'.
+func knownAuthors(as []model.Answer, names map[bson.ObjectId]string) []model.Answer {
+    known := as[:0]
+    for _, a := range as {
+        _, ffound := names[a.Fuid]
+        _, lfound := names[a.Luid]
+        if ffound && lfound {
+            known = append(known, a)
+        }
+    }
+    return known
+}
+
+// Fill in the names of the answers' first and last authors. All of them must
+// exist. The authors of anonymous answers are then hidden from the viewer,
+// see 'maskAnonymous'.
+func (st *Settings) setAnswerNames(as []model.Answer, names map[bson.ObjectId]string, viewer *Viewer) error {
+    for i := range as {
+        fudisp, ffound := names[as[i].Fuid]
+        ludisp, lfound := names[as[i].Luid]
+        if !ffound || !lfound {
+            return newError(model.ERR_NOT_FOUND, "Unable to find user")
+        }
+        as[i].Fudisp = fudisp
+        as[i].Ludisp = ludisp
+    }
+    st.maskAnonymous(as, viewer)
+    return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "github.com/inSituo/Denormalizer/model"
+    "gopkg.in/mgo.v2/bson"
+    "testing"
+)
+
+func TestUserNamesHelpers(t *testing.T) {
+    u1, u2, u3 := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+    names := map[bson.ObjectId]string{u1: "alice", u2: "bob"}
+
+    // joins keep their order, missing users are left out:
+    qjs := questionJoins([]bson.ObjectId{u2, u3, u1}, names)
+    if len(qjs) != 2 || qjs[0].Udisp != "bob" || qjs[1].Udisp != "alice" {
+        t.Error("unexpected joins", qjs)
+    }
+
+    cmts := []model.Comment{{Uid: u1}, {Uid: u3}}
+    setCommentNames(cmts, names)
+    if cmts[0].Udisp != "alice" || cmts[1].Udisp != "" {
+        t.Error("unexpected comment names", cmts)
+    }
+
+    as := []model.Answer{{Fuid: u1, Luid: u2}}
+    if uids := answerUids(as); len(uids) != 2 {
+        t.Error("unexpected answer authors", uids)
+    }
+    if err := testSettings.setAnswerNames(as, names, nil); err != nil || as[0].Fudisp != "alice" || as[0].Ludisp != "bob" {
+        t.Error("unexpected answer names", as, err)
+    }
+    // answer authors must exist:
+    as = []model.Answer{{Fuid: u1, Luid: u3}}
+    if err := testSettings.setAnswerNames(as, names, nil); err == nil || asError(err).Code != model.ERR_NOT_FOUND {
+        t.Error("expected a NOT_FOUND error, got", err)
+    }
+    // unless the answers with missing authors are left out first:
+    as = []model.Answer{{Fuid: u1, Luid: u3}, {Fuid: u2, Luid: u1}}
+    if as = knownAuthors(as, names); len(as) != 1 || as[0].Fuid != u2 {
+        t.Error("unexpected known authors", as)
+    }
+}
+
+func TestUserFields(t *testing.T) {
+    fields, err := parseUserFields(" avatar, profile.bio ,")
+    if err != nil || len(fields) != 2 || fields[1] != "profile.bio" {
+        t.Error("unexpected fields", fields, err)
+    }
+    if fields, err := parseUserFields("profile.bio,profile.biography"); err != nil || len(fields) != 2 {
+        t.Error("unexpected overlap", fields, err)
+    }
+    if fields, err := parseUserFields(""); err != nil || len(fields) != 0 {
+        t.Error("expected no fields", fields, err)
+    }
+    for _, bad := range []string{"$where", "name", "avatar,_id", "avatar,avatar", "profile,profile.bio", "profile.bio,profile"} {
+        if _, err := parseUserFields(bad); err == nil {
+            t.Error("expected an invalid field error", bad)
+        }
+    }
+}
+
+func TestAuthoredPipeline(t *testing.T) {
+    uid := bson.NewObjectId()
+    stages := authoredPipeline(uid, bson.M{"anon": bson.M{"$ne": true}}, bson.M{"thanks": bson.M{"$sum": "$thanks"}})
+    match := stages[0]["$match"].(bson.M)
+    if match["revs.uid"] != uid || match["anon"] == nil {
+        t.Error("unexpected match", match)
+    }
+    group := stages[len(stages)-1]["$group"].(bson.M)
+    if group["thanks"] == nil || group["n"] == nil {
+        t.Error("unexpected group", group)
+    }
+}
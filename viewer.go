@@ -0,0 +1,116 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "github.com/inSituo/Denormalizer/model"
+    "gopkg.in/mgo.v2/bson"
+)
+
+// Options which identify the user the results are for. They are only
+// trusted if signed with the key of the '-viewersecretfile':
+//
+//	@viewer=<user ID> @role=moderator @sig=<hex HMAC-SHA256 of "ID\x00role">
+//
+// The role is optional (sign "ID\x00" then).
+const (
+    OPTION_VIEWER = "viewer"
+    OPTION_ROLE   = "role"
+    OPTION_SIG    = "sig"
+
+    VIEWER_ROLE_MODERATOR = "moderator"
+)
+
+// The options which identify the viewer, to be listed in the 'Options' of
+// the commands whose result depends on the viewer.
+var viewerOptions = []string{OPTION_VIEWER, OPTION_ROLE, OPTION_SIG}
+
+// The user a request is made for, as vouched for by the signature.
+type Viewer struct {
+    ID        bson.ObjectId
+    Moderator bool
+}
+
+// May the viewer see the authors of an answer written by 'author'?
+// A nil viewer may not.
+func (v *Viewer) trusts(author bson.ObjectId) bool {
+    return v != nil && (v.Moderator || v.ID == author)
+}
+
+// The signature of the viewer options.
+func (st *Settings) signViewer(id, role string) string {
+    mac := hmac.New(sha256.New, st.viewerKey)
+    mac.Write([]byte(id + "\x00" + role))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Parse the viewer options. Returns nil if the request has no viewer, and an
+// error if the viewer options are not correctly signed.
+func (st *Settings) parseViewer(opts map[string]string) (*Viewer, error) {
+    id, found := opts[OPTION_VIEWER]
+    if !found {
+        return nil, nil
+    }
+    if len(st.viewerKey) == 0 {
+        return nil, badArgs("Viewer options are not accepted by this server")
+    }
+    if !bson.IsObjectIdHex(id) {
+        return nil, badArgs("Viewer is an invalid BSON ObjectId")
+    }
+    role := opts[OPTION_ROLE]
+    if !hmac.Equal([]byte(opts[OPTION_SIG]), []byte(st.signViewer(id, role))) {
+        return nil, badArgs("Invalid viewer signature")
+    }
+    return &Viewer{
+        ID:        bson.ObjectIdHex(id),
+        Moderator: role == VIEWER_ROLE_MODERATOR,
+    }, nil
+}
+
+// Add flags telling if the viewer is in arrays of user IDs to a pipeline
+// which groups the documents by their fields: the flags are computed in the
+// '$group' stage's 'id', and copied by the '$project' stage. 'flags' maps the
+// names of the flags to the arrays. Nothing is added if the viewer is nil.
+func (v *Viewer) addFlags(id, project bson.M, flags map[string]string) {
+    if v == nil {
+        return
+    }
+    for flag, array := range flags {
+        id[flag] = bson.M{
+            "$in": []interface{}{v.ID, bson.M{"$ifNull": []interface{}{array, []interface{}{}}}},
+        }
+        project[flag] = "$_id." + flag
+    }
+}
+
+// Hide the editors of an anonymous answer's revisions, unless the viewer is
+// the answer's author or a moderator. The contributors are merged into one,
+// so their number is hidden too.
+func (st *Settings) maskHistory(h *model.AnswerHistory, anon bool, author bson.ObjectId, viewer *Viewer) {
+    if !anon || viewer.trusts(author) {
+        return
+    }
+    for i := range h.Revisions {
+        h.Revisions[i].Uid = ""
+        h.Revisions[i].Udisp = st.anonName
+    }
+    edits := 0
+    for _, c := range h.Contributors {
+        edits += c.Edits
+    }
+    h.Contributors = []model.Contributor{{Udisp: st.anonName, Edits: edits}}
+}
+
+// Hide the authors of anonymous answers, unless the viewer wrote the answer
+// or is a moderator.
+func (st *Settings) maskAnonymous(as []model.Answer, viewer *Viewer) {
+    for i := range as {
+        a := &as[i]
+        if !a.Anon || viewer.trusts(a.Fuid) {
+            continue
+        }
+        a.Fuid, a.Luid = "", ""
+        a.Fudisp, a.Ludisp = st.anonName, st.anonName
+    }
+}
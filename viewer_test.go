@@ -0,0 +1,159 @@
+package main
+
+import (
+    "github.com/inSituo/Denormalizer/model"
+    "gopkg.in/mgo.v2/bson"
+    "testing"
+)
+
+func TestParseViewer(t *testing.T) {
+    st := &Settings{viewerKey: []byte("test")}
+    uid := bson.NewObjectId()
+
+    if v, err := st.parseViewer(map[string]string{}); v != nil || err != nil {
+        t.Error("expected no viewer", v, err)
+    }
+    v, err := st.parseViewer(map[string]string{
+        "viewer": uid.Hex(),
+        "sig":    st.signViewer(uid.Hex(), ""),
+    })
+    if err != nil || v.ID != uid || v.Moderator {
+        t.Error("unexpected viewer", v, err)
+    }
+    v, err = st.parseViewer(map[string]string{
+        "viewer": uid.Hex(),
+        "role":   "moderator",
+        "sig":    st.signViewer(uid.Hex(), "moderator"),
+    })
+    if err != nil || !v.Moderator {
+        t.Error("expected a moderator", v, err)
+    }
+    // the role is signed too:
+    if _, err := st.parseViewer(map[string]string{
+        "viewer": uid.Hex(),
+        "role":   "moderator",
+        "sig":    st.signViewer(uid.Hex(), ""),
+    }); err == nil {
+        t.Error("expected an invalid signature error")
+    }
+    if _, err := st.parseViewer(map[string]string{"viewer": uid.Hex()}); err == nil {
+        t.Error("expected an invalid signature error")
+    }
+    st = &Settings{}
+    if _, err := st.parseViewer(map[string]string{
+        "viewer": uid.Hex(),
+        "sig":    st.signViewer(uid.Hex(), ""),
+    }); err == nil {
+        t.Error("expected viewers to be rejected without a secret")
+    }
+}
+
+func TestMaskAnonymous(t *testing.T) {
+    author, editor, other := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+    names := map[bson.ObjectId]string{author: "alice", editor: "bob", other: "carol"}
+    answers := func() []model.Answer {
+        return []model.Answer{
+            {Fuid: author, Luid: editor, Anon: true},
+            {Fuid: other, Luid: other, Anon: false},
+        }
+    }
+    masked := func(a model.Answer) bool {
+        return a.Fuid == "" && a.Luid == "" && a.Fudisp == testSettings.anonName && a.Ludisp == testSettings.anonName
+    }
+
+    // no viewer, or another user: the anonymous answer is masked
+    for _, viewer := range []*Viewer{nil, {ID: other}, {ID: editor}} {
+        as := answers()
+        if err := testSettings.setAnswerNames(as, names, viewer); err != nil {
+            t.Fatal(err)
+        }
+        if !masked(as[0]) {
+            t.Error("anonymous answer not masked for", viewer, as[0])
+        }
+        if as[1].Fuid != other || as[1].Fudisp != "carol" {
+            t.Error("answer masked for", viewer, as[1])
+        }
+    }
+
+    // the author and moderators see the authors
+    for _, viewer := range []*Viewer{{ID: author}, {ID: other, Moderator: true}} {
+        as := answers()
+        if err := testSettings.setAnswerNames(as, names, viewer); err != nil {
+            t.Fatal(err)
+        }
+        if as[0].Fuid != author || as[0].Fudisp != "alice" || as[0].Ludisp != "bob" {
+            t.Error("anonymous answer masked for", viewer, as[0])
+        }
+    }
+}
+
+func TestViewerFlags(t *testing.T) {
+    // the flags are only computed for a viewer:
+    stages := answerPipeline(bson.M{}, nil)
+    project := stages[len(stages)-1]["$project"].(bson.M)
+    if _, found := project["viewerThanked"]; found {
+        t.Error("unexpected viewer flag without a viewer")
+    }
+
+    viewer := &Viewer{ID: bson.NewObjectId()}
+    stages = answerPipeline(bson.M{}, viewer)
+    id := stages[len(stages)-2]["$group"].(bson.M)["_id"].(bson.M)
+    project = stages[len(stages)-1]["$project"].(bson.M)
+    for _, flag := range []string{"viewerThanked", "viewerThumbedUp", "viewerThumbedDown"} {
+        if project[flag] != "$_id."+flag {
+            t.Error("flag not projected", flag, project[flag])
+        }
+        in := id[flag].(bson.M)["$in"].([]interface{})
+        if in[0] != viewer.ID {
+            t.Error("flag not computed for the viewer", flag, in)
+        }
+    }
+
+    stages = questionPipeline(bson.M{}, viewer)
+    project = stages[len(stages)-1]["$project"].(bson.M)
+    if project["viewerJoined"] != "$_id.viewerJoined" {
+        t.Error("viewerJoined not projected", project)
+    }
+}
+
+func TestMaskHistory(t *testing.T) {
+    author, editor := bson.NewObjectId(), bson.NewObjectId()
+    history := func() *model.AnswerHistory {
+        return &model.AnswerHistory{
+            Revisions: []model.AnswerRevision{
+                {Index: 1, Uid: editor, Udisp: "bob"},
+                {Index: 0, Uid: author, Udisp: "alice"},
+            },
+            Contributors: []model.Contributor{
+                {Uid: author, Udisp: "alice", Edits: 2},
+                {Uid: editor, Udisp: "bob", Edits: 1},
+            },
+        }
+    }
+
+    h := history()
+    testSettings.maskHistory(h, true, author, &Viewer{ID: editor})
+    for _, r := range h.Revisions {
+        if r.Uid != "" || r.Udisp != testSettings.anonName {
+            t.Error("revision not masked", r)
+        }
+    }
+    if len(h.Contributors) != 1 || h.Contributors[0].Uid != "" || h.Contributors[0].Edits != 3 {
+        t.Error("contributors not merged", h.Contributors)
+    }
+
+    for _, c := range []struct {
+        anon   bool
+        viewer *Viewer
+    }{
+        {false, nil},
+        {true, &Viewer{ID: author}},
+        {true, &Viewer{ID: editor, Moderator: true}},
+    } {
+        h := history()
+        testSettings.maskHistory(h, c.anon, author, c.viewer)
+        if h.Revisions[0].Udisp != "bob" || len(h.Contributors) != 2 {
+            t.Error("history masked", c.anon, c.viewer, h)
+        }
+    }
+}
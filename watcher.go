@@ -0,0 +1,312 @@
+package main
+
+import (
+    "github.com/inSituo/LeveledLogger"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+    "io/ioutil"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    // How long the oplog cursor waits for new entries before the watcher
+    // checks whether it was stopped.
+    WATCH_TAIL_TIMEOUT = 1 * time.Second
+
+    // How long to wait before reopening the oplog cursor after an error.
+    WATCH_RETRY_DELAY = 1 * time.Second
+
+    // How often the resume token is saved while entries are processed.
+    WATCH_SAVE_INTERVAL = 1 * time.Second
+)
+
+// An entry of the MongoDB oplog.
+type oplogEntry struct {
+    TS bson.MongoTimestamp `bson:"ts"`
+    Op string              `bson:"op"`
+    NS string              `bson:"ns"`
+    O  bson.M              `bson:"o"`
+    O2 bson.M              `bson:"o2"`
+}
+
+// The watcher tails the MongoDB oplog and evicts the cache entries affected
+// by each change to the questions, answers, comments and users collections.
+// It also keeps the geo field of the written questions up to date, see
+// 'UpdateGeo'. The oplog is only available when MongoDB runs as a replica set.
+//
+// The timestamp of the last processed entry is the resume token. It is saved
+// to a file, so a restarted watcher continues where the previous one stopped.
+type Watcher struct {
+    db    *DB
+    cache *Cache
+    log   *LeveledLogger.Logger
+
+    // The geo field of the questions (the '-geofield' flag). Empty to not
+    // update it.
+    geoField string
+
+    // Path of the resume token file. Empty to not save the token.
+    tokenFile string
+
+    // The timestamp of the last processed oplog entry.
+    last bson.MongoTimestamp
+
+    // When the resume token was last saved.
+    saved time.Time
+
+    // Closed to signal the watcher to stop; 'donec' is closed in return.
+    stopc chan bool
+    donec chan bool
+}
+
+// Construct a new watcher. The 'db' connection is copied.
+func NewWatcher(db *DB, cache *Cache, geoField, tokenFile string, ll_level int) *Watcher {
+    return &Watcher{
+        db:        db.Copy(),
+        cache:     cache,
+        log:       LeveledLogger.New(os.Stdout, ll_level),
+        geoField:  geoField,
+        tokenFile: tokenFile,
+        stopc:     make(chan bool),
+        donec:     make(chan bool),
+    }
+}
+
+// Stop the watcher and wait until the resume token is saved.
+func (wt *Watcher) Stop() {
+    close(wt.stopc)
+    <-wt.donec
+}
+
+func (wt *Watcher) stopped() bool {
+    select {
+    case <-wt.stopc:
+        return true
+    default:
+        return false
+    }
+}
+
+// Run the watcher until 'Stop' is called.
+func (wt *Watcher) Run() {
+    iname := "Watcher.Run"
+    defer close(wt.donec)
+    defer wt.db.Close()
+
+    oplog := wt.db.Oplog()
+    if err := wt.resume(oplog); err != nil {
+        wt.log.Warn(iname, "unable to find where to resume, watcher stopped", err)
+        return
+    }
+    namespaces := []string{
+        wt.db.Questions.FullName,
+        wt.db.Answers.FullName,
+        wt.db.Comments.FullName,
+        wt.db.Users.FullName,
+    }
+    wt.log.Info(iname, "watching for changes", namespaces)
+
+    for !wt.stopped() {
+        if err := wt.checkGap(oplog); err != nil {
+            wt.log.Warn(iname, "unable to read the oplog", err)
+        }
+        iter := oplog.Find(bson.M{
+            "ts": bson.M{"$gt": wt.last},
+            "ns": bson.M{"$in": namespaces},
+        }).LogReplay().Tail(WATCH_TAIL_TIMEOUT)
+        var entry oplogEntry
+        for !wt.stopped() {
+            if iter.Next(&entry) {
+                wt.handle(&entry)
+                wt.last = entry.TS
+                if time.Since(wt.saved) > WATCH_SAVE_INTERVAL {
+                    wt.save()
+                }
+                continue
+            }
+            if !iter.Timeout() {
+                break
+            }
+            // no new entries:
+            wt.save()
+        }
+        if err := iter.Close(); err != nil {
+            wt.log.Warn(iname, "oplog cursor failed", err)
+        }
+        if wt.stopped() {
+            break
+        }
+        select {
+        case <-wt.stopc:
+        case <-time.After(WATCH_RETRY_DELAY):
+            wt.db.Refresh()
+        }
+    }
+    wt.save()
+    wt.log.Debug(iname, "stopped")
+}
+
+// Find the oplog timestamp to resume from: the saved resume token, or the
+// latest oplog entry if there is none.
+func (wt *Watcher) resume(oplog *mgo.Collection) error {
+    iname := "Watcher.resume"
+    if wt.tokenFile != "" {
+        data, err := ioutil.ReadFile(wt.tokenFile)
+        if err == nil {
+            ts, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+            if err == nil {
+                wt.last = bson.MongoTimestamp(ts)
+                wt.log.Info(iname, "resuming from saved token", ts)
+                return nil
+            }
+            wt.log.Warn(iname, "invalid resume token, ignored", err)
+        } else if !os.IsNotExist(err) {
+            wt.log.Warn(iname, "unable to read resume token", err)
+        }
+    }
+    var latest oplogEntry
+    if err := oplog.Find(nil).Sort("-$natural").One(&latest); err != nil {
+        return err
+    }
+    wt.last = latest.TS
+    return nil
+}
+
+// Make sure the oplog still has the entries after the last processed one. If
+// they were dropped (the resume token is older than the oplog, or the watcher
+// fell behind), the changes they recorded are lost: the whole cache is evicted
+// and the watcher continues from the latest entry.
+func (wt *Watcher) checkGap(oplog *mgo.Collection) error {
+    iname := "Watcher.checkGap"
+    var oldest oplogEntry
+    if err := oplog.Find(nil).Sort("$natural").One(&oldest); err != nil {
+        if err == mgo.ErrNotFound {
+            return nil
+        }
+        return err
+    }
+    if wt.last >= oldest.TS {
+        return nil
+    }
+    var latest oplogEntry
+    if err := oplog.Find(nil).Sort("-$natural").One(&latest); err != nil {
+        return err
+    }
+    wt.log.Warn(iname, "the oplog has no entries after the resume token, changes were missed, evicting the cache", int64(wt.last), int64(oldest.TS))
+    wt.cache.Purge()
+    wt.last = latest.TS
+    return nil
+}
+
+// Save the resume token. The token is written to a temporary file which is
+// then renamed, so a crash can't leave a truncated token behind.
+func (wt *Watcher) save() {
+    iname := "Watcher.save"
+    if wt.tokenFile == "" || wt.last == 0 {
+        return
+    }
+    tmp := wt.tokenFile + ".tmp"
+    data := []byte(strconv.FormatInt(int64(wt.last), 10) + "\n")
+    if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+        wt.log.Warn(iname, "unable to save resume token", err)
+        return
+    }
+    if err := os.Rename(tmp, wt.tokenFile); err != nil {
+        wt.log.Warn(iname, "unable to save resume token", err)
+        return
+    }
+    wt.saved = time.Now()
+}
+
+// Evict the cache entries affected by an oplog entry.
+// Every cache entry is tagged with the IDs of the objects it embeds (see
+// 'cacheTags'), so evicting the changed object's ID covers updates and
+// deletes of questions, answers, comments and users. Answers and comments
+// also evict their question, as new ones change its lists. New questions
+// evict the lists of questions ('TAG_QUESTIONS'), and new questions and
+// answers the profile of their author ('profileTag').
+func (wt *Watcher) handle(entry *oplogEntry) {
+    iname := "Watcher.handle"
+    doc := entry.O
+    if entry.Op == "u" {
+        doc = entry.O2
+    }
+    id, ok := doc["_id"].(bson.ObjectId)
+    if !ok {
+        return
+    }
+    tags := []string{id.Hex()}
+    switch entry.NS {
+    case wt.db.Questions.FullName:
+        if entry.Op == "i" {
+            tags = append(tags, TAG_QUESTIONS)
+            if uid, found := firstEditor(entry.O); found {
+                tags = append(tags, profileTag(uid.Hex()))
+            }
+        }
+        if wt.geoField != "" && (entry.Op == "i" || entry.Op == "u") {
+            // updating the field is a change too, it is then up to date:
+            if _, err := UpdateGeo(wt.db, wt.geoField, id); err != nil {
+                wt.log.Warn(iname, "unable to update the question's location", id.Hex(), err)
+            }
+        }
+    case wt.db.Answers.FullName:
+        if parent, found := wt.parent(entry, wt.db.Answers, "qid"); found {
+            tags = append(tags, parent.Hex())
+        }
+        if entry.Op == "i" {
+            if uid, found := firstEditor(entry.O); found {
+                tags = append(tags, profileTag(uid.Hex()))
+            }
+        }
+    case wt.db.Comments.FullName:
+        if parent, found := wt.parent(entry, wt.db.Comments, "oid"); found {
+            tags = append(tags, parent.Hex())
+        }
+    }
+    n := 0
+    for _, tag := range tags {
+        n += wt.cache.Invalidate(tag)
+    }
+    wt.log.Debug(iname, "change", entry.NS, entry.Op, tags, "evicted", n)
+}
+
+// Find the ID of the parent object of an inserted or updated document, from
+// the oplog entry itself or from the database. Deleted documents can't be
+// looked up, but the lists which contained them carry their ID.
+func (wt *Watcher) parent(entry *oplogEntry, c *mgo.Collection, field string) (bson.ObjectId, bool) {
+    if entry.Op == "i" {
+        parent, ok := entry.O[field].(bson.ObjectId)
+        return parent, ok
+    }
+    if entry.Op != "u" {
+        return "", false
+    }
+    var doc bson.M
+    if err := c.FindId(entry.O2["_id"]).Select(bson.M{field: true}).One(&doc); err != nil {
+        if err != mgo.ErrNotFound {
+            wt.log.Warn("Watcher.parent", "unable to find parent", c.FullName, err)
+        }
+        return "", false
+    }
+    parent, ok := doc[field].(bson.ObjectId)
+    return parent, ok
+}
+
+// The author of an inserted question or answer: the editor of its first
+// revision, as counted by 'U'.
+func firstEditor(doc bson.M) (bson.ObjectId, bool) {
+    revs, ok := doc["revs"].([]interface{})
+    if !ok || len(revs) == 0 {
+        return "", false
+    }
+    rev, ok := revs[0].(bson.M)
+    if !ok {
+        return "", false
+    }
+    uid, ok := rev["uid"].(bson.ObjectId)
+    return uid, ok
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+    "github.com/inSituo/LeveledLogger"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+    "io/ioutil"
+    "testing"
+    "time"
+)
+
+func TestWatcherInserts(t *testing.T) {
+    c := NewCache(10, map[string]time.Duration{"QL": time.Minute, "U": time.Minute, "Q": time.Minute})
+    wt := &Watcher{
+        db: &DB{
+            Users:     &mgo.Collection{FullName: "test.users"},
+            Questions: &mgo.Collection{FullName: "test.questions"},
+            Answers:   &mgo.Collection{FullName: "test.answers"},
+            Comments:  &mgo.Collection{FullName: "test.comments"},
+        },
+        cache: c,
+        log:   LeveledLogger.New(ioutil.Discard, LeveledLogger.LL_INFO),
+    }
+    qid := bson.ObjectIdHex("53fb63a4472dcb6b32e99260")
+    uid := bson.ObjectIdHex("53fb63a4472dcb6b32e99261")
+    ql := []string{"QL", "il", "10", "0", "ts"}
+    u := []string{"U", uid.Hex()}
+    q := []string{"Q", qid.Hex()}
+    put := func() {
+        for _, params := range [][]string{ql, u, q} {
+            c.Put(params, []byte("{}"), true, cacheTags(params, nil))
+        }
+    }
+    revs := []interface{}{bson.M{"uid": uid, "ts": 1}}
+
+    // a new question evicts the lists of questions and its author's profile:
+    put()
+    wt.handle(&oplogEntry{Op: "i", NS: "test.questions", O: bson.M{"_id": bson.NewObjectId(), "revs": revs}})
+    if _, _, found := c.Get(ql); found {
+        t.Error("expected QL to be evicted")
+    }
+    if _, _, found := c.Get(u); found {
+        t.Error("expected U to be evicted")
+    }
+    if _, _, found := c.Get(q); !found {
+        t.Error("expected Q to stay cached")
+    }
+
+    // a new answer evicts its question and its author's profile:
+    c.Purge()
+    put()
+    wt.handle(&oplogEntry{Op: "i", NS: "test.answers", O: bson.M{"_id": bson.NewObjectId(), "qid": qid, "revs": revs}})
+    if _, _, found := c.Get(u); found {
+        t.Error("expected U to be evicted")
+    }
+    if _, _, found := c.Get(q); found {
+        t.Error("expected Q to be evicted")
+    }
+    if _, _, found := c.Get(ql); !found {
+        t.Error("expected QL to stay cached")
+    }
+}
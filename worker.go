@@ -2,11 +2,13 @@ package main
 
 import (
     "encoding/json"
-    "errors"
+    "expvar"
     "fmt"
+    "github.com/inSituo/Denormalizer/model"
     "github.com/inSituo/LeveledLogger"
-    "gopkg.in/mgo.v2/bson"
     "os"
+    "strconv"
+    "time"
 )
 
 // Work to be done by a worker
@@ -20,6 +22,40 @@ type Work struct {
     // Used to determine the task to be performed by the workers and the
     // arguments for this task.
     params []string
+
+    // The request options, see 'splitOptions'.
+    opts map[string]string
+
+    // The work must be done by this time. Work which is still in the buffer
+    // when the deadline passes is dropped.
+    deadline time.Time
+
+    // Identical works share the same key, see 'requestKey'.
+    key string
+
+    // If set, the product is sent into this channel instead of the products
+    // queue. Used by requests which don't come from the ROUTER socket. Must
+    // be buffered, so the worker never blocks on it.
+    replyc chan *Product
+}
+
+// Send the product of the work to whoever requested it.
+func (work *Work) reply(prod *Product, prodq chan *Product) {
+    prod.id = work.id
+    if work.replyc != nil {
+        work.replyc <- prod
+        return
+    }
+    prodq <- prod
+}
+
+// Send a failure product with the error to whoever requested the work.
+func (work *Work) fail(err error, prodq chan *Product) {
+    work.reply(&Product{
+        success: false,
+        empty:   false,
+        payload: errorPayload(err),
+    }, prodq)
 }
 
 // The result of a worker's work.
@@ -40,6 +76,11 @@ type Product struct {
     // The result of the work, or an error description.
     // If the work succeeded, this is the result encoded as a JSON string.
     payload []byte
+
+    // The products of the commands of a batch, in order. If set, the reply
+    // is made of their success, empty and payload parts instead of this
+    // product's own.
+    parts []*Product
 }
 
 // A worker receives work through a 'work queue' and produces products. The
@@ -50,127 +91,185 @@ type Worker struct {
 
     db  *DB
 
+    // The settings of the commands, shared by all the workers.
+    settings *Settings
+
+    // The results cache, shared by all the workers.
+    cache *Cache
+
+    // Works waiting for the products of this worker's works.
+    coalescer *Coalescer
+
     log *LeveledLogger.Logger
 
-    // A buffered channel which the worker constantly polls for new work.
+    // A buffered channel which the worker constantly polls for new work. The
+    // dispatcher pushes work into it, and closes it to shut the worker down.
     workq chan *Work
 
     // A buffered channel into which the worker pushes work products.
     prodq chan *Product
-
-    // An unbuffered channel which is used to signal the worker to shut down.
-    stopc chan bool
 }
 
-// Construct a new worker object.
+// Construct a new worker object with a work buffer of size 'wbuff'.
 // Notice that the 'db' connection is copied, and not used as is. This means
 // a new database connection will be made.
 func NewWorker(
     id int,
-    workq chan *Work,
+    wbuff int,
     prodq chan *Product,
     db *DB,
+    settings *Settings,
+    cache *Cache,
+    coalescer *Coalescer,
     ll_level int,
 ) *Worker {
-    return &Worker{
-        ID:    id,
-        db:    db.Copy(),
-        log:   LeveledLogger.New(os.Stdout, ll_level),
-        workq: workq,
-        prodq: prodq,
-        stopc: make(chan bool),
+    w := &Worker{
+        ID:        id,
+        db:        db.Copy(),
+        settings:  settings,
+        cache:     cache,
+        coalescer: coalescer,
+        log:       LeveledLogger.New(os.Stdout, ll_level),
+        workq:     make(chan *Work, wbuff),
+        prodq:     prodq,
+    }
+    queueDepth.Set(strconv.Itoa(id), expvar.Func(func() interface{} {
+        return w.QueueDepth()
+    }))
+    return w
+}
+
+// Number of work items waiting in the worker's buffer.
+func (w *Worker) QueueDepth() int {
+    return len(w.workq)
+}
+
+// Execute the command requested by a work item.
+func (w *Worker) execute(work *Work) (interface{}, bool, error) {
+    cmd, found := commands[work.params[0]]
+    if !found {
+        return nil, false, newError(model.ERR_UNKNOWN_COMMAND, "Unknown command")
     }
+    args, err := cmd.Parse(w.settings, work.params, work.opts)
+    if err != nil {
+        return nil, false, err
+    }
+    return cmd.Handle(w, args)
 }
 
-// Shut down the worker.
-func (w *Worker) Stop() {
-    w.stopc <- true
-    w.db.Close()
-    <-w.stopc
+// The parameters under which the result of a work item is cached: the
+// request parameters, followed by the options which change the result.
+func cacheParams(work *Work) []string {
+    cmd, found := commands[work.params[0]]
+    if !found || len(cmd.Options) == 0 {
+        return work.params
+    }
+    params := append([]string{}, work.params...)
+    for _, name := range cmd.Options {
+        if value, found := work.opts[name]; found {
+            params = append(params, OPTION_PREFIX+name+"="+value)
+        }
+    }
+    return params
+}
+
+// Produce the JSON payload of a work item, from the cache if possible.
+// The '@nocache' option skips the cache lookup; the fresh result is still
+// stored.
+// Return:
+//  1. The JSON payload, nil if the requested object does not exist
+//  2. (bool) Does the requested object exist?
+//  3. (error) Nil or an error
+func (w *Worker) produce(work *Work) ([]byte, bool, error) {
+    key := cacheParams(work)
+    if _, nocache := work.opts["nocache"]; !nocache {
+        if payload, exists, found := w.cache.Get(key); found {
+            return payload, exists, nil
+        }
+    }
+    w.db.SetDeadline(work.deadline)
+    res, exists, err := w.execute(work)
+    if err != nil {
+        if IsTimeout(err) {
+            timeouts.Add(1)
+            w.db.Refresh()
+            return nil, false, ErrTimeout
+        }
+        return nil, false, err
+    }
+    var payload []byte
+    if exists {
+        if payload, err = json.Marshal(res); err != nil {
+            return nil, false, err
+        }
+    }
+    w.cache.Put(key, payload, exists, cacheTags(work.params, res))
+    return payload, exists, nil
 }
 
 // Run the worker and start polling for new work.
+// Returns after the work buffer is closed and every work item left in it is
+// done. The worker's database connection is closed on return.
 func (w *Worker) Run() {
     iname := fmt.Sprintf("Worker(%d)", w.ID)
+    defer w.db.Close()
 
     w.log.Debug(iname, "ready")
 
-    for {
-        select {
-        case work := <-w.workq:
-            var err error
-            var exists bool
-            var res interface{}
-            switch work.params[0] {
-            case "Q": // question
-                var qid bson.ObjectId
-                qid, err = parseOid(work.params)
-                if err == nil {
-                    res, exists, err = w.GetQuestion(qid)
-                }
-            case "QJ": // question joins
-                var count, page int
-                var qid bson.ObjectId
-                qid, count, page, err = parseOidCountPage(work.params)
-                if err == nil {
-                    res, exists, err = w.GetQuestionJoins(qid, count, page)
-                }
-            case "QLC": // question latest comments
-                var count, page int
-                var qid bson.ObjectId
-                qid, count, page, err = parseOidCountPage(work.params)
-                if err == nil {
-                    res, exists, err = w.GetQuestionLatestComments(qid, count, page)
-                }
-            case "A": // answer
-                var aid bson.ObjectId
-                aid, err = parseOid(work.params)
-                if err == nil {
-                    res, exists, err = w.GetAnswer(aid)
-                }
-            case "QTA": // question top answers
-                var count, page int
-                var qid bson.ObjectId
-                qid, count, page, err = parseOidCountPage(work.params)
-                if err == nil {
-                    res, exists, err = w.GetTopAnswers(qid, count, page)
-                }
-            case "QLA": // question latest answers
-                var count, page int
-                var qid bson.ObjectId
-                qid, count, page, err = parseOidCountPage(work.params)
-                if err == nil {
-                    res, exists, err = w.GetLatestAnswers(qid, count, page)
-                }
-            default:
-                err = errors.New("unknown task")
-            }
-            var payload []byte
-            if err == nil && exists {
-                payload, err = json.Marshal(res)
-            }
-            if err == nil {
-                w.log.Info(iname, "task completed", work.params[0])
-                w.prodq <- &Product{
-                    id:      work.id,
-                    success: true,
-                    empty:   !exists,
-                    payload: payload,
-                }
-            } else {
-                w.log.Warn(iname, "task failed", work.params[0], err)
-                w.prodq <- &Product{
-                    id:      work.id,
-                    success: false,
-                    empty:   false,
-                    payload: []byte(err.Error()),
-                }
-            }
-        case <-w.stopc:
-            w.log.Debug(iname, "stopped")
-            // release the Stop method:
-            defer func() { w.stopc <- true }()
-            return
+    for work := range w.workq {
+        w.handle(iname, work)
+    }
+    w.log.Debug(iname, "stopped")
+}
+
+// Do a work item and reply to it, and to the identical works waiting for its
+// product (see 'Coalescer'). They get the same product, unless the work timed
+// out: the waiting works whose deadline hasn't passed yet are then done again,
+// starting with the one with the latest deadline. The request stays in flight
+// until a product is ready, so identical requests keep waiting for it.
+func (w *Worker) handle(iname string, work *Work) {
+    for work != nil {
+        prod, err := w.do(iname, work)
+        waiting, next := w.coalescer.Release(work, func(wk *Work) bool {
+            return err == ErrTimeout && time.Now().Before(wk.deadline)
+        })
+        for _, wk := range waiting {
+            p := *prod
+            wk.reply(&p, w.prodq)
         }
+        work.reply(prod, w.prodq)
+        work = next
+    }
+}
+
+// Do a work item, unless it expired in the buffer.
+// Return:
+//  1. The product of the work
+//  2. (error) Nil or the error of the failure product, ErrTimeout if the work
+//     timed out
+func (w *Worker) do(iname string, work *Work) (*Product, error) {
+    var payload []byte
+    var exists bool
+    var err error
+    if time.Now().After(work.deadline) {
+        w.log.Warn(iname, "task expired in the buffer", work.params[0])
+        timeouts.Add(1)
+        err = ErrTimeout
+    } else {
+        payload, exists, err = w.produce(work)
+    }
+    if err != nil {
+        w.log.Warn(iname, "task failed", work.params[0], err)
+        return &Product{
+            success: false,
+            empty:   false,
+            payload: errorPayload(err),
+        }, err
     }
+    w.log.Info(iname, "task completed", work.params[0])
+    return &Product{
+        success: true,
+        empty:   !exists,
+        payload: payload,
+    }, nil
 }